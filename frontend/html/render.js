@@ -34,13 +34,66 @@ function getCookie(name) {
 function eraseCookie(name) {   
     document.cookie = name+'=; Max-Age=-99999999;';  
 }
+// Set when the last response came from an impersonation session, to the uid of the operator.
+var impersonatedBy = null;
 function httpGetSync(theUrl)
 {
     var xmlHttp = new XMLHttpRequest();
     xmlHttp.open( "GET", theUrl, false ); // false for synchronous request
     xmlHttp.send( null );
+    impersonatedBy = xmlHttp.getResponseHeader("X-Impersonated-By");
     return xmlHttp.responseText;
 }
+function httpPostSync(theUrl, body, contentType)
+{
+    var xmlHttp = new XMLHttpRequest();
+    xmlHttp.open( "POST", theUrl, false ); // false for synchronous request
+    if(contentType) {
+        xmlHttp.setRequestHeader("Content-Type", contentType);
+    }
+    // The server refuses POST requests without the CSRF token of the session.
+    let csrf = getCookie("csrf_token");
+    if(csrf) {
+        xmlHttp.setRequestHeader("X-Csrf-Token", csrf);
+    }
+    xmlHttp.send( body );
+    return xmlHttp.responseText;
+}
+// apiPost calls a method that changes something. The arguments of the url go in the POST body,
+// so that they do not end up in logs.
+function apiPost(theUrl)
+{
+    let i = theUrl.indexOf("?");
+    if(i == -1) {
+        return httpPostSync(theUrl, "", "application/x-www-form-urlencoded");
+    }
+    return httpPostSync(theUrl.substring(0, i), theUrl.substring(i + 1), "application/x-www-form-urlencoded");
+}
+// apiPostDownload is apiPost for a method answering with a file, which the browser saves as fileName.
+function apiPostDownload(theUrl, fileName)
+{
+    let i = theUrl.indexOf("?");
+    var xmlHttp = new XMLHttpRequest();
+    xmlHttp.open( "POST", i == -1 ? theUrl : theUrl.substring(0, i), true );
+    xmlHttp.responseType = "blob";
+    xmlHttp.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+    let csrf = getCookie("csrf_token");
+    if(csrf) {
+        xmlHttp.setRequestHeader("X-Csrf-Token", csrf);
+    }
+    xmlHttp.onload = () => {
+        if(xmlHttp.status != 200) {
+            xmlHttp.response.text().then(text => alert("Failed. " + text));
+            return;
+        }
+        let link = document.createElement("a");
+        link.href = URL.createObjectURL(xmlHttp.response);
+        link.download = fileName;
+        link.click();
+        URL.revokeObjectURL(link.href);
+    };
+    xmlHttp.send( i == -1 ? "" : theUrl.substring(i + 1) );
+}
 function httpGetAsync(theUrl)
 {
     var xmlHttp = new XMLHttpRequest();
@@ -58,8 +111,54 @@ function httpGetAsyncCallback(theUrl, callback)
     xmlHttp.send(null);
 }
 
+// parse "a=1&b=2" into {a: "1", b: "2"}
+function parseKV(line) {
+    let res = {};
+    line.split("&").forEach(kv => {
+        let i = kv.indexOf("=");
+        if(i != -1) {
+            res[kv.substring(0, i)] = kv.substring(i + 1);
+        }
+    });
+    return res;
+}
+
+// parse the response of a list API: a first line "total=&offset=&limit=", then one row per line.
+function parseList(text) {
+    let i = text.indexOf("\n");
+    let head = parseKV(i == -1 ? text : text.substring(0, i));
+    return {
+        total: parseInt(head["total"]),
+        offset: parseInt(head["offset"]),
+        limit: parseInt(head["limit"]),
+        body: i == -1 ? "" : text.substring(i + 1),
+    };
+}
+// buttons to move between the pages of a list, calling loadFunc(offset).
+function pagerHTML(list, loadFunc) {
+    let last = Math.min(list.offset + list.limit, list.total);
+    let res = '<p>{0}-{1} of {2} '.format(list.total == 0 ? 0 : list.offset + 1, last, list.total);
+    if(list.offset > 0) {
+        res += '<button class="button is-small" onclick="{0}({1});">Previous</button> '.format(loadFunc, Math.max(list.offset - list.limit, 0));
+    }
+    if(last < list.total) {
+        res += '<button class="button is-small" onclick="{0}({1});">Next</button>'.format(loadFunc, last);
+    }
+    return res + '</p>';
+}
+
 ///// libs done
 
+function stopImpersonation() {
+    let resp = apiPost("/api/StopImpersonation");
+    if(resp != "status=ok") {
+        alert("Failed. " + resp);
+    }
+    setCookie("name", getCookie("impersonator_name"), 365);
+    eraseCookie("impersonator_name");
+    window.location.href = "/users.html";
+}
+
 function generateTabs(nameUrlMap) {
     let res = "";
     Object.keys(nameUrlMap).forEach(key => {
@@ -89,23 +188,34 @@ function renderTabs(elementId) {
         tabsMap["Me"] = "/me.html";
         tabsMap["ChangePassword"] = "/changePassword.html";
         perms.forEach(perm => {
-            if(perm == "root") {
+            if(perm == "database.reset") {
                 tabsMap["ResetDatabase"] = "/resetDatabase.html";
-                tabsMap["User"] = "/users.html"; // root user can add/remove all users
             }
-            else if(perm == "customer_service") {
-                tabsMap["Plan"] = "/plans.html"; // may add/view plan
+            else if(perm == "user.view") {
                 tabsMap["User"] = "/users.html"; // may set user's plan, see user's info
             }
-            else if(perm == "cashier") {
+            else if(perm == "plan.view") {
+                tabsMap["Plan"] = "/plans.html"; // may add/view plan
+            }
+            else if(perm == "balance.topup") {
                 tabsMap["AddCredit"] = "/addCredit.html"; // may charge customer
             }
+            else if(perm == "balance.batch") {
+                tabsMap["BalanceBatches"] = "/batches.html"; // adjust many balances at once
+            }
+            else if(perm == "promotion.manage" || perm == "promotion.redeem") {
+                tabsMap["Promotions"] = "/promotions.html"; // discount codes
+            }
             else if(perm == "customer") {
                 tabsMap["MyTransactions"] = "/history.html"; // balance log
             }
         });
         document.getElementById("topbar-contents").innerHTML = generateTabs(tabsMap);
-        logoutHTML = '<a class="navbar-item" href="/home.html" onclick="httpGetSync(\'/api/Logout\');">Logout</a>';
+        logoutHTML = '<a class="navbar-item" href="/home.html" onclick="apiPost(\'/api/Logout\');">Logout</a>';
+        if(impersonatedBy) {
+            logoutHTML = '<span class="navbar-item has-text-danger">Viewing as {0}, read-only</span>'.format(getCookie("name"))
+                + '<a class="navbar-item" onclick="stopImpersonation();">Stop viewing</a>';
+        }
         document.getElementById("topbar-right-contents").innerHTML = logoutHTML;
     }
 
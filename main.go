@@ -2,8 +2,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/Chips-zhang/DBProjectHust/service"
 	"github.com/Chips-zhang/DBProjectHust/tools"
@@ -13,7 +18,7 @@ import (
 
 func createTables() {
 
-	for _, model := range []interface{}{&tools.UserInfo{}, &tools.UserBalanceEvent{}, &tools.PlanInfo{}} {
+	for _, model := range tools.TableModels() {
 		err := tools.DB_.CreateTable(model, &orm.CreateTableOptions{
 			IfNotExists: true,
 		})
@@ -24,6 +29,15 @@ func createTables() {
 	}
 }
 
+func migrateTables() {
+	if err := tools.Migrate(tools.DB_); err != nil {
+		panic("Unable to migrate table: " + err.Error())
+	}
+	if err := tools.SeedBuiltinRoles(tools.DB_); err != nil {
+		panic("Unable to seed built-in roles: " + err.Error())
+	}
+}
+
 func tryCreateRootAccount(password string) {
 	u := tools.UserInfo{Id: tools.RootUid}
 	err := tools.DB_.Select(&u)
@@ -34,7 +48,7 @@ func tryCreateRootAccount(password string) {
 			// create root account
 			u.Password = tools.PasswordSaltedHash(password, tools.PasswordSalt)
 			u.Name = "root"
-			u.Permissions = tools.RolesPermission[tools.RoleAdmin]
+			u.Roles = []string{tools.RoleAdmin}
 			u.Email = "root@recolic.net"
 			err2 := tools.DB_.Insert(&u)
 			if err2 != nil {
@@ -46,17 +60,108 @@ func tryCreateRootAccount(password string) {
 	}
 }
 
+// envOr reads the default of a flag from the environment, so that secrets stay off the command line.
+func envOr(key, fallback string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+	return fallback
+}
+
+func createMailer(backend, host, port, username, password, from, tlsMode, dir string) tools.Mailer {
+	switch backend {
+	case "smtp":
+		portNum, err := strconv.Atoi(port)
+		if err != nil {
+			panic("Invalid SMTP port: " + port)
+		}
+		if tlsMode != tools.TLSModeStartTLS && tlsMode != tools.TLSModeImplicit && tlsMode != tools.TLSModeNone {
+			panic("Invalid SMTP TLS mode: " + tlsMode)
+		}
+		return &tools.SMTPMailer{Host: host, Port: portNum, Username: username, Password: password, From: from, TLSMode: tlsMode}
+	case "file":
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			panic("Unable to create mail directory: " + err.Error())
+		}
+		return &tools.FileMailer{Dir: dir, From: from}
+	case "discard", "memory":
+		return tools.DiscardMailer{}
+	}
+	panic("Unknown mail backend: " + backend)
+}
+
+// importUsers runs a user import as root from the command line, prints the report and tells whether
+// every row was valid.
+func importUsers(path, mode string) bool {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic("Unable to read the users to import: " + err.Error())
+	}
+	grants, err := tools.UserGrants(tools.RootUid)
+	if err != nil {
+		panic("Unable to load the permissions of root: " + err.Error())
+	}
+	report, err := service.ImportUsers(tools.Actor{Uid: tools.RootUid, Grants: grants, UserAgent: "import-users"}, string(content), mode)
+	if err != nil {
+		log.Print("Import failed. " + err.Error())
+		return false
+	}
+	fmt.Print(report)
+	return !strings.Contains(report, "result=invalid") && !strings.Contains(report, "result=failed")
+}
+
 func main() {
-	tools.InitAuthModule()
-	tools.InitCommon()
 	dbUsername := flag.String("user", "postgres", "Username for PostgreSQL.")
 	dbAddr := flag.String("addr", "127.0.0.1:5432", "Address for PostgreSQL.")
 	dbPswd := flag.String("password", "", "Password for PostgreSQL.")
 	httpBindAddr := flag.String("listen", ":80", "Listen address for http server.")
 	defaultRootPassword := flag.String("root-password", "P@ssw0rd", "For first-time launch, set this parameter to set root password.")
+	mailBackend := flag.String("mail-backend", envOr("MAIL_BACKEND", "smtp"), "Where emails go: smtp, file (write .eml files) or discard.")
+	smtpHost := flag.String("smtp-host", envOr("SMTP_HOST", "smtp.recolic.net"), "SMTP server host.")
+	smtpPort := flag.String("smtp-port", envOr("SMTP_PORT", "587"), "SMTP server port.")
+	smtpUser := flag.String("smtp-user", envOr("SMTP_USER", ""), "SMTP username. Empty to skip authentication.")
+	smtpPassword := flag.String("smtp-password", envOr("SMTP_PASSWORD", ""), "SMTP password. Prefer the SMTP_PASSWORD environment variable.")
+	smtpTLS := flag.String("smtp-tls", envOr("SMTP_TLS", tools.TLSModeStartTLS), "SMTP TLS mode: starttls, tls or none.")
+	mailFrom := flag.String("mail-from", envOr("MAIL_FROM", "no-reply-hust@recolic.net"), "Sender address of outgoing emails.")
+	mailDir := flag.String("mail-dir", envOr("MAIL_DIR", "mail"), "Directory for the file mail backend.")
+	flag.IntVar(&tools.OutboxMaxAttempts, "mail-max-attempts", tools.OutboxMaxAttempts, "Delivery attempts before an email is marked failed.")
+	flag.StringVar(&tools.Brand, "brand", envOr("BRAND", tools.Brand), "Carrier brand name used in emails.")
+	templateDir := flag.String("template-dir", "templates/email", "Directory of the email templates.")
+	flag.DurationVar(&service.NumberQuarantinePeriod, "number-quarantine", service.NumberQuarantinePeriod, "How long a released phone number stays quarantined before reuse.")
+	flag.DurationVar(&service.NumberReservationPeriod, "number-reservation", service.NumberReservationPeriod, "How long a customer service reservation holds a phone number.")
+	flag.IntVar(&service.InvoiceDueDays, "invoice-due-days", service.InvoiceDueDays, "Days a postpaid customer has to pay an invoice.")
+	enableBilling := flag.Bool("billing", true, "Bill every customer's plan when a month is over, and chase overdue invoices.")
+	flag.Var(&service.DunningReminderDays, "dunning-reminder-days", "Days after the due date to send payment reminders, comma-separated.")
+	flag.IntVar(&service.LateFeeDays, "late-fee-days", service.LateFeeDays, "Days after the due date to charge the late fee. Negative to disable.")
+	flag.Var(&service.LateFee, "late-fee", "Late fee charged on an overdue invoice.")
+	flag.IntVar(&service.DunningSuspendDays, "dunning-suspend-days", service.DunningSuspendDays, "Days after the due date to suspend the account. Negative to disable.")
+	flag.IntVar(&service.DunningCollectionsDays, "dunning-collections-days", service.DunningCollectionsDays, "Days after the due date to hand the account to collections. Negative to disable.")
+	flag.IntVar(&tools.MaxFailedLogins, "max-failed-logins", tools.MaxFailedLogins, "Consecutive wrong passwords that lock an account.")
+	flag.DurationVar(&tools.LockoutDuration, "lockout-duration", tools.LockoutDuration, "How long a locked account refuses every password.")
+	flag.DurationVar(&tools.SessionIdleTimeout, "session-idle-timeout", tools.SessionIdleTimeout, "How long a session lasts without requests.")
+	flag.DurationVar(&tools.SessionMaxAge, "session-max-age", tools.SessionMaxAge, "How long a session lasts at most after the login.")
+	flag.DurationVar(&tools.ImpersonationTTL, "impersonation-ttl", tools.ImpersonationTTL, "How long an operator may view the API as a customer.")
+	flag.BoolVar(&service.SecureCookies, "secure-cookies", service.SecureCookies, "Mark session cookies Secure even when requests do not look like HTTPS.")
+	flag.DurationVar(&service.CookieMaxAge, "cookie-max-age", service.CookieMaxAge, "How long browsers keep the session cookies.")
+	flag.IntVar(&service.LoginRateLimit.Burst, "login-rate-burst", service.LoginRateLimit.Burst, "Login attempts an IP may make at once.")
+	flag.DurationVar(&service.LoginRateLimit.Interval, "login-rate-interval", service.LoginRateLimit.Interval, "Time for an IP to earn one more login attempt.")
+	flag.Var(&service.DefaultLowBalanceThreshold, "low-balance-threshold", "Balance below which customers are notified, unless they set their own threshold.")
+	flag.IntVar(&service.RetentionYears, "retention-years", service.RetentionYears, "Years to keep the personal data of removed users before anonymizing it. 0 to keep it forever.")
+	importUsersPath := flag.String("import-users", "", "Import the users of a CSV file (name,email,role,plan,balance) as root, print the report and exit.")
+	importMode := flag.String("import-mode", service.ImportDryRun, "How -import-users imports: dry_run, all_or_nothing or best_effort.")
+	smsGateway := flag.String("sms-gateway", "", "URL of the SMS gateway for customer notifications. Empty to notify by email only.")
 
 	flag.Parse()
 
+	if err := tools.LoadEmailTemplates(*templateDir); err != nil {
+		panic("Unable to load email templates: " + err.Error())
+	}
+	tools.DefaultMailer = createMailer(*mailBackend, *smtpHost, *smtpPort, *smtpUser, *smtpPassword, *mailFrom, *smtpTLS, *mailDir)
+
+	if *smsGateway != "" {
+		service.NotificationChannels = append(service.NotificationChannels, service.SmsChannel{GatewayURL: *smsGateway})
+	}
+
 	log.Printf("Connecting PostgreSQL %s as %s...", *dbAddr, *dbUsername)
 	tools.DB_ = pg.Connect(&pg.Options{
 		User:     *dbUsername,
@@ -67,9 +172,29 @@ func main() {
 
 	// create table if not exist
 	createTables()
+	migrateTables()
 
 	tryCreateRootAccount(*defaultRootPassword)
 
+	if *importUsersPath != "" {
+		if !importUsers(*importUsersPath, *importMode) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	go tools.RunOutboxWorker()
+	service.ResumeBalanceBatches()
+
+	if *enableBilling {
+		go service.RunBillingWorker()
+		go service.RunDunningWorker()
+	}
+
+	if service.RetentionYears > 0 {
+		go service.RunRetentionWorker()
+	}
+
 	log.Printf("HTTP listening %s.", *httpBindAddr)
 	http.HandleFunc("/", service.HttpApiFunc)
 	err := http.ListenAndServe(*httpBindAddr, nil)
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+)
+
+// formatOptionalTime formats a time that may be unset, as empty.
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func apiKeySnapshot(k tools.ApiKey) map[string]string {
+	return map[string]string{"owner_uid": fmt.Sprint(k.OwnerUid), "prefix": k.Prefix, "permissions": k.Permissions,
+		"allowed_ips": strings.Join(k.AllowedIps, ","), "expires": formatOptionalTime(k.ExpiresAt),
+		"revoked": formatOptionalTime(k.RevokedAt)}
+}
+
+// CreateApiKey issues a key acting as the owner user, restricted to the permissions listed in permStr.
+// The key is only ever returned here and by RotateApiKey.
+func CreateApiKey(commiter tools.Actor, name, ownerName, permStr, ipsStr, expiresStr string) (string, error) {
+	if commiter.Can(tools.PermApiKeyManage) == false {
+		return "", errors.New("Permission denied.")
+	}
+	if !tools.RoleNameRegex.MatchString(name) {
+		return "", errors.New("Invalid key name. Use 1 to 32 lowercase letters, digits and '_'.")
+	}
+	owner, err := tools.UsernameToInfo(ownerName)
+	if err != nil {
+		return "", err
+	}
+	if owner.Id == tools.RootUid {
+		return "", errors.New("API keys cannot act as root. Create a user for the service.")
+	}
+	// Whoever may create a key may act as its owner, so the commiter must be allowed to manage the owner.
+	if checkUserUpdatePermission(commiter, owner.Roles) == false {
+		return "", errors.New("Permission denied.")
+	}
+
+	limit, err := tools.ParseGrants("", permStr)
+	if err != nil {
+		return "", err
+	}
+	if len(limit) == 0 {
+		return "", errors.New("A key must hold at least one permission.")
+	}
+	ips, err := tools.ParseIpAllowlist(ipsStr)
+	if err != nil {
+		return "", err
+	}
+	k := tools.ApiKey{Name: name, OwnerUid: owner.Id, Permissions: permStr, AllowedIps: ips, CreatedAt: time.Now()}
+	if expiresStr != "" {
+		if k.ExpiresAt, err = parseAuditTime(expiresStr); err != nil {
+			return "", err
+		}
+		if k.ExpiresAt.Before(k.CreatedAt) {
+			return "", errors.New("The expiry is in the past.")
+		}
+	}
+
+	key, prefix, hash, err := tools.GenerateApiKey()
+	if err != nil {
+		return "", err
+	}
+	k.Prefix = prefix
+	k.KeyHash = hash
+
+	err = tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		res, err := tx.Model(&k).OnConflict("DO NOTHING").Insert()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return errors.New("API key already exists: " + name)
+		}
+		return tools.Audit(tx, commiter, "CreateApiKey", name, nil, apiKeySnapshot(k))
+	})
+	if err != nil {
+		return "", err
+	}
+	return "name=" + name + "&key=" + key, nil
+}
+
+func ListApiKeys(commiter tools.Actor) (string, error) {
+	if commiter.Can(tools.PermApiKeyManage) == false {
+		return "", errors.New("Permission denied.")
+	}
+
+	var keys []tools.ApiKey
+	err := tools.DB_.Model(&keys).Order("name").Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+	names, err := apiKeyOwnerNames(keys)
+	if err != nil {
+		return "", err
+	}
+
+	result := ""
+	for _, k := range keys {
+		result += fmt.Sprintf("name=%s&owner=%s&prefix=%s&permissions=%s&allowed_ips=%s&expires=%s&created=%s&last_used=%s&revoked=%s\n",
+			k.Name, names[k.OwnerUid], k.Prefix, k.Permissions, strings.Join(k.AllowedIps, ","),
+			formatOptionalTime(k.ExpiresAt), formatOptionalTime(k.CreatedAt), formatOptionalTime(k.LastUsedAt),
+			formatOptionalTime(k.RevokedAt))
+	}
+	return result, nil
+}
+
+func apiKeyOwnerNames(keys []tools.ApiKey) (map[tools.UidT]string, error) {
+	var uids []tools.UidT
+	for _, k := range keys {
+		uids = append(uids, k.OwnerUid)
+	}
+	return userNames(uids)
+}
+
+// userNames maps uids to the names of the users.
+func userNames(uids []tools.UidT) (map[tools.UidT]string, error) {
+	names := make(map[tools.UidT]string)
+	if len(uids) == 0 {
+		return names, nil
+	}
+	var users []tools.UserInfo
+	err := tools.DB_.Model(&users).Column("id", "name").Where("id IN (?)", pg.In(uids)).Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return nil, err
+	}
+	for _, u := range users {
+		names[u.Id] = u.Name
+	}
+	return names, nil
+}
+
+// activeApiKey loads a key that is not revoked, for an update.
+func activeApiKey(tx *pg.Tx, name string) (tools.ApiKey, error) {
+	k := tools.ApiKey{}
+	err := tx.Model(&k).Where("name = ?", name).For("UPDATE").Select()
+	if err != nil {
+		if err.Error() == tools.PgNotFoundErr {
+			return k, errors.New("API key not found: " + name)
+		}
+		return k, err
+	}
+	if !k.RevokedAt.IsZero() {
+		return k, errors.New("The API key is revoked.")
+	}
+	return k, nil
+}
+
+// RotateApiKey replaces the secret of a key, keeping its settings. The old key stops working at once.
+func RotateApiKey(commiter tools.Actor, name string) (string, error) {
+	if commiter.Can(tools.PermApiKeyManage) == false {
+		return "", errors.New("Permission denied.")
+	}
+
+	key, prefix, hash, err := tools.GenerateApiKey()
+	if err != nil {
+		return "", err
+	}
+	err = tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		k, err := activeApiKey(tx, name)
+		if err != nil {
+			return err
+		}
+		before := apiKeySnapshot(k)
+
+		k.Prefix = prefix
+		k.KeyHash = hash
+		_, err = tx.Model(&k).Set("prefix = ?prefix, key_hash = ?key_hash").WherePK().Update()
+		if err != nil {
+			return err
+		}
+		return tools.Audit(tx, commiter, "RotateApiKey", name, before, apiKeySnapshot(k))
+	})
+	if err != nil {
+		return "", err
+	}
+	return "name=" + name + "&key=" + key, nil
+}
+
+// RevokeApiKey disables a key for good. It stays listed, for the audit log to refer to.
+func RevokeApiKey(commiter tools.Actor, name string) error {
+	if commiter.Can(tools.PermApiKeyManage) == false {
+		return errors.New("Permission denied.")
+	}
+
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		k, err := activeApiKey(tx, name)
+		if err != nil {
+			return err
+		}
+		before := apiKeySnapshot(k)
+
+		k.RevokedAt = time.Now()
+		_, err = tx.Model(&k).Set("revoked_at = ?revoked_at").WherePK().Update()
+		if err != nil {
+			return err
+		}
+		return tools.Audit(tx, commiter, "RevokeApiKey", name, before, apiKeySnapshot(k))
+	})
+}
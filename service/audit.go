@@ -0,0 +1,122 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+)
+
+const maxAuditEntries = 1000
+
+// parseAuditTime accepts RFC 3339 timestamps and plain dates.
+func parseAuditTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, errors.New("Invalid time, use 2006-01-02 or RFC 3339: " + s)
+	}
+	return t, nil
+}
+
+// selectAuditEntries returns the newest entries matching every non-empty filter, with the names of their actors.
+func selectAuditEntries(commiter tools.Actor, actorName, action, target, since, until string) ([]tools.AuditEntry, map[tools.UidT]string, error) {
+	if commiter.Can(tools.PermAuditView) == false {
+		return nil, nil, errors.New("Permission denied.")
+	}
+
+	var entries []tools.AuditEntry
+	q := tools.DB_.Model(&entries)
+	if actorName != "" {
+		actor, err := tools.UsernameToInfo(actorName)
+		if err != nil {
+			return nil, nil, err
+		}
+		q = q.Where("actor_uid = ?", actor.Id)
+	}
+	if action != "" {
+		q = q.Where("action = ?", action)
+	}
+	if target != "" {
+		q = q.Where("target = ?", target)
+	}
+	if since != "" {
+		t, err := parseAuditTime(since)
+		if err != nil {
+			return nil, nil, err
+		}
+		q = q.Where("time >= ?", t)
+	}
+	if until != "" {
+		t, err := parseAuditTime(until)
+		if err != nil {
+			return nil, nil, err
+		}
+		q = q.Where("time < ?", t)
+	}
+
+	err := q.Order("id DESC").Limit(maxAuditEntries).Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return nil, nil, err
+	}
+
+	// Actors may have been removed since, their entries then show the uid only.
+	names := make(map[tools.UidT]string)
+	if len(entries) > 0 {
+		var uids []tools.UidT
+		for _, e := range entries {
+			uids = append(uids, e.ActorUid)
+		}
+		var users []tools.UserInfo
+		err = tools.DB_.Model(&users).Column("id", "name").Where("id IN (?)", pg.In(uids)).Select()
+		if err != nil && err.Error() != tools.PgNotFoundErr {
+			return nil, nil, err
+		}
+		for _, u := range users {
+			names[u.Id] = u.Name
+		}
+	}
+	return entries, names, nil
+}
+
+// QueryAuditLog lists audit entries, one per line. Free-text values are URL-encoded.
+func QueryAuditLog(commiter tools.Actor, actorName, action, target, since, until string) (string, error) {
+	entries, names, err := selectAuditEntries(commiter, actorName, action, target, since, until)
+	if err != nil {
+		return "", err
+	}
+
+	result := ""
+	for _, e := range entries {
+		result += fmt.Sprintf("id=%d&time=%s&actor_uid=%d&actor=%s&action=%s&target=%s&before=%s&after=%s&ip=%s&user_agent=%s&api_key=%s\n",
+			e.Id, e.Time.Format(time.RFC3339), e.ActorUid, names[e.ActorUid], e.Action, url.QueryEscape(e.Target),
+			url.QueryEscape(e.Before), url.QueryEscape(e.After), e.SourceIp, url.QueryEscape(e.UserAgent), e.ApiKey)
+	}
+	return result, nil
+}
+
+// ExportAuditLog returns the same entries as QueryAuditLog as a CSV document.
+func ExportAuditLog(commiter tools.Actor, actorName, action, target, since, until string) (string, error) {
+	entries, names, err := selectAuditEntries(commiter, actorName, action, target, since, until)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{"id", "time", "actor_uid", "actor", "action", "target", "before", "after", "ip", "user_agent", "api_key"})
+	for _, e := range entries {
+		_ = w.Write([]string{strconv.FormatInt(e.Id, 10), e.Time.Format(time.RFC3339), strconv.FormatInt(int64(e.ActorUid), 10),
+			names[e.ActorUid], e.Action, e.Target, e.Before, e.After, e.SourceIp, e.UserAgent, e.ApiKey})
+	}
+	w.Flush()
+	return buf.String(), w.Error()
+}
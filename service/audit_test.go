@@ -0,0 +1,30 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIp(t *testing.T) {
+	r := &http.Request{RemoteAddr: "127.0.0.1:5123", Header: http.Header{}}
+	r.Header.Set("X-Forwarded-For", "10.0.0.1, 203.0.113.7")
+	if clientIp(r) != "203.0.113.7" {
+		t.Error("proxied client ip boom: " + clientIp(r))
+	}
+
+	r.RemoteAddr = "198.51.100.2:5123"
+	if clientIp(r) != "198.51.100.2" {
+		t.Error("forwarded header of a remote client must be ignored: " + clientIp(r))
+	}
+}
+
+func TestParseAuditTime(t *testing.T) {
+	for _, s := range []string{"2020-01-02", "2020-01-02T15:04:05Z"} {
+		if _, err := parseAuditTime(s); err != nil {
+			t.Error("audit time boom: " + s)
+		}
+	}
+	if _, err := parseAuditTime("yesterday"); err == nil {
+		t.Error("bad audit time accepted")
+	}
+}
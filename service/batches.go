@@ -0,0 +1,554 @@
+package service
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+)
+
+// BatchChunkSize is how many accounts a batch adjusts in one transaction.
+var BatchChunkSize = 200
+
+const maxBatchAccounts = 100000
+
+// BatchSelector chooses the customers of a batch. The filters combine, Names lists accounts explicitly.
+type BatchSelector struct {
+	Plan   string
+	Status string
+	Names  []string
+}
+
+func (s BatchSelector) empty() bool {
+	return s.Plan == "" && s.Status == "" && len(s.Names) == 0
+}
+
+// String is the selector as the API arguments.
+func (s BatchSelector) String() string {
+	args := url.Values{}
+	if s.Plan != "" {
+		args.Set("plan", s.Plan)
+	}
+	if s.Status != "" {
+		args.Set("status", s.Status)
+	}
+	if len(s.Names) > 0 {
+		args.Set("names", strings.Join(s.Names, ","))
+	}
+	return args.Encode()
+}
+
+// batchListEntry is one line of an uploaded batch list. Amount is zero when the line gives none.
+type batchListEntry struct {
+	Name   string
+	Amount tools.MoneyT
+}
+
+// parseBatchList reads an uploaded list with the columns name and, optionally, amount.
+func parseBatchList(content string) ([]batchListEntry, error) {
+	reader := csv.NewReader(strings.NewReader(content))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var entries []batchListEntry
+	seen := make(map[string]bool)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) > 2 {
+			return nil, fmt.Errorf("Line %d: expected name,amount.", line)
+		}
+		if line == 1 && strings.EqualFold(record[0], "name") {
+			continue
+		}
+
+		entry := batchListEntry{Name: strings.TrimSpace(record[0])}
+		if entry.Name == "" || !tools.UsernameRegex.MatchString(entry.Name) {
+			return nil, fmt.Errorf("Line %d: invalid username.", line)
+		}
+		if seen[entry.Name] {
+			return nil, fmt.Errorf("Line %d: %s is listed twice.", line, entry.Name)
+		}
+		seen[entry.Name] = true
+		if len(record) == 2 && strings.TrimSpace(record[1]) != "" {
+			if entry.Amount, err = tools.StringToMoneyT(strings.TrimSpace(record[1])); err != nil || entry.Amount == 0 {
+				return nil, fmt.Errorf("Line %d: invalid amount.", line)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("The list is empty.")
+	}
+	return entries, nil
+}
+
+// batchCustomers resolves the customers of a batch, removed users excepted, by name.
+func batchCustomers(selector BatchSelector) (map[string]tools.UidT, error) {
+	var users []tools.UserInfo
+	q := tools.DB_.Model(&users).Column("id", "name").
+		Where("status <> ?", tools.StatusRemoved).
+		Where("roles && ARRAY(SELECT role FROM role_grants WHERE permission = ?)", tools.PermCustomer)
+	if selector.Plan != "" {
+		q = q.Where("plan IN (SELECT id FROM plan_infos WHERE name = ?)", selector.Plan)
+	}
+	if selector.Status != "" {
+		q = q.Where("status = ?", selector.Status)
+	}
+	if len(selector.Names) > 0 {
+		q = q.Where("name IN (?)", pg.In(selector.Names))
+	}
+	if err := q.Limit(maxBatchAccounts + 1).Select(); err != nil && err.Error() != tools.PgNotFoundErr {
+		return nil, err
+	}
+	if len(users) > maxBatchAccounts {
+		return nil, fmt.Errorf("A batch must adjust at most %d accounts.", maxBatchAccounts)
+	}
+
+	uids := make(map[string]tools.UidT)
+	for _, u := range users {
+		uids[u.Name] = u.Id
+	}
+	for _, name := range selector.Names {
+		if _, ok := uids[name]; !ok {
+			return nil, errors.New("Not a customer matching the selector: " + name)
+		}
+	}
+	return uids, nil
+}
+
+// CreateBalanceBatch freezes the accounts of a batch and their amounts in a draft, to be previewed with
+// QueryBalanceBatch and then applied. The accounts come from the selector, or from an uploaded list
+// whose lines may override the amount. The note goes into every ledger entry.
+func CreateBalanceBatch(commiter tools.Actor, selector BatchSelector, list, amountStr, note string) (tools.BatchidT, error) {
+	if commiter.Can(tools.PermBalanceBatch) == false {
+		return 0, errors.New("Permission denied.")
+	}
+	note = strings.TrimSpace(note)
+	if note == "" || strings.ContainsAny(note, ";\r\n") {
+		return 0, errors.New("A batch needs a single-line note without ';'.")
+	}
+	amount := tools.MoneyT(0)
+	if amountStr != "" {
+		var err error
+		if amount, err = tools.StringToMoneyT(amountStr); err != nil {
+			return 0, err
+		}
+	}
+
+	var entries []batchListEntry
+	describe := selector.String()
+	if list != "" {
+		if !selector.empty() {
+			return 0, errors.New("Select the accounts or upload a list, not both.")
+		}
+		var err error
+		if entries, err = parseBatchList(list); err != nil {
+			return 0, err
+		}
+		for _, entry := range entries {
+			selector.Names = append(selector.Names, entry.Name)
+		}
+		describe = "list=" + strconv.Itoa(len(entries))
+	} else {
+		if selector.empty() {
+			return 0, errors.New("Select the accounts by plan, status or names.")
+		}
+	}
+
+	uids, err := batchCustomers(selector)
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		for name := range uids {
+			entries = append(entries, batchListEntry{Name: name})
+		}
+	}
+	if len(entries) == 0 {
+		return 0, errors.New("No account matches the selector.")
+	}
+
+	batch := tools.BalanceBatch{Note: note, Selector: describe, State: tools.BatchDraft, Accounts: len(entries),
+		CreatedBy: commiter.Uid, CreatedAt: time.Now()}
+	items := make([]tools.BalanceBatchItem, len(entries))
+	for i, entry := range entries {
+		items[i] = tools.BalanceBatchItem{UId: uids[entry.Name], Amount: entry.Amount}
+		if items[i].Amount == 0 {
+			items[i].Amount = amount
+		}
+		if items[i].Amount == 0 {
+			return 0, errors.New("No amount for " + entry.Name)
+		}
+		if commiter.Grants.Allows(tools.PermBalanceBatch, items[i].Amount) == false {
+			return 0, errors.New("The amount of " + entry.Name + " exceeds your limit of " + commiter.Grants[tools.PermBalanceBatch].String())
+		}
+		batch.TotalAmount += items[i].Amount
+	}
+
+	err = tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tx.Insert(&batch); err != nil {
+			return err
+		}
+		for i := range items {
+			items[i].BatchId = batch.Id
+		}
+		for start := 0; start < len(items); start += BatchChunkSize {
+			end := start + BatchChunkSize
+			if end > len(items) {
+				end = len(items)
+			}
+			chunk := items[start:end]
+			if err := tx.Insert(&chunk); err != nil {
+				return err
+			}
+		}
+		return tools.Audit(tx, commiter, "CreateBalanceBatch", batchTarget(batch.Id), nil, batch)
+	})
+	return batch.Id, err
+}
+
+func batchTarget(id tools.BatchidT) string {
+	return "batch " + strconv.FormatInt(int64(id), 10)
+}
+
+func formatBalanceBatch(b tools.BalanceBatch, createdBy string) string {
+	return fmt.Sprintf("id=%d&state=%s&note=%s&selector=%s&accounts=%d&done=%d&total_amount=%s&created_by=%s&created=%s&applied=%s&reversed=%s&error=%s",
+		b.Id, b.State, url.QueryEscape(b.Note), url.QueryEscape(b.Selector), b.Accounts, b.Done, b.TotalAmount.String(),
+		createdBy, formatOptionalTime(b.CreatedAt), formatOptionalTime(b.AppliedAt), formatOptionalTime(b.ReversedAt),
+		url.QueryEscape(b.Error))
+}
+
+// ListBalanceBatches lists one page of the batches, newest first.
+func ListBalanceBatches(commiter tools.Actor, page Page) (string, error) {
+	if commiter.Can(tools.PermBalanceBatch) == false {
+		return "", errors.New("Permission denied.")
+	}
+	if page.Sort == "" {
+		page.Sort, page.Desc = "id", true
+	}
+
+	var batches []tools.BalanceBatch
+	q, err := page.apply(tools.DB_.Model(&batches), map[string]string{"id": "id", "state": "state"}, "id", "id")
+	if err != nil {
+		return "", err
+	}
+	total, err := q.SelectAndCount()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+	var uids []tools.UidT
+	for _, b := range batches {
+		uids = append(uids, b.CreatedBy)
+	}
+	names, err := userNames(uids)
+	if err != nil {
+		return "", err
+	}
+
+	result := page.header(total)
+	for _, b := range batches {
+		result += formatBalanceBatch(b, names[b.CreatedBy]) + "\n"
+	}
+	return result, nil
+}
+
+// QueryBalanceBatch shows a batch on its first line, then one page of its accounts with their balance
+// and the balance the adjustment leads to, which previews a draft.
+func QueryBalanceBatch(commiter tools.Actor, id tools.BatchidT, page Page) (string, error) {
+	if commiter.Can(tools.PermBalanceBatch) == false {
+		return "", errors.New("Permission denied.")
+	}
+	batch := tools.BalanceBatch{Id: id}
+	if err := tools.DB_.Select(&batch); err != nil {
+		if err.Error() == tools.PgNotFoundErr {
+			return "", errors.New("Batch not found.")
+		}
+		return "", err
+	}
+
+	var items []tools.BalanceBatchItem
+	q, err := page.apply(tools.DB_.Model(&items).Where("batch_id = ?", id),
+		map[string]string{"uid": "u_id", "amount": "amount"}, "uid", "u_id")
+	if err != nil {
+		return "", err
+	}
+	total, err := q.SelectAndCount()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+
+	uids := []tools.UidT{batch.CreatedBy}
+	for _, item := range items {
+		uids = append(uids, item.UId)
+	}
+	var users []tools.UserInfo
+	err = tools.DB_.Model(&users).Column("id", "name", "balance").Where("id IN (?)", pg.In(uids)).Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+	userOf := make(map[tools.UidT]tools.UserInfo)
+	for _, u := range users {
+		userOf[u.Id] = u
+	}
+
+	result := formatBalanceBatch(batch, userOf[batch.CreatedBy].Name) + "\n" + page.header(total)
+	for _, item := range items {
+		u := userOf[item.UId]
+		newBalance := u.Balance
+		if batch.State == tools.BatchDraft {
+			newBalance += item.Amount
+		}
+		result += fmt.Sprintf("name=%s&amount=%s&balance=%s&new_balance=%s&applied=%t&reversed=%t\n",
+			u.Name, item.Amount.String(), u.Balance.String(), newBalance.String(), item.Applied, item.Reversed)
+	}
+	return result, nil
+}
+
+// batchClaimable tells whether a batch is in one of the given states and may be claimed from it. A
+// running or reversing batch is claimed only once it stopped on an error, so that nothing races its
+// worker.
+func batchClaimable(batch tools.BalanceBatch, from []string) bool {
+	if (batch.State == tools.BatchRunning || batch.State == tools.BatchReversing) && batch.Error == "" {
+		return false
+	}
+	return tools.ArrayContains(from, batch.State)
+}
+
+// reopenedDue is what a customer owes again on an invoice a reversed credit had paid, 0 if the
+// balance still covers it and the invoice stays paid.
+func reopenedDue(settledDue, balance tools.MoneyT) tools.MoneyT {
+	if balance >= 0 {
+		return 0
+	}
+	if -balance < settledDue {
+		return -balance
+	}
+	return settledDue
+}
+
+// reopenSettledInvoices reopens the invoices of a customer that a batch credit paid, once the credit is
+// reversed, as far as the balance no longer covers them.
+func reopenSettledInvoices(tx *pg.Tx, u tools.UserInfo, id tools.BatchidT) error {
+	var invoices []tools.Invoice
+	err := tx.Model(&invoices).
+		Where("u_id = ? AND settled_by_batch = ? AND state = ?", u.Id, id, tools.InvoicePaid).Order("id").Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return err
+	}
+	for _, invoice := range invoices {
+		due := reopenedDue(invoice.SettledDue, u.Balance)
+		if due == 0 {
+			continue
+		}
+		_, err := tx.Model(&invoice).
+			Set("state = ?, amount_due = ?, paid_at = NULL, settled_by_batch = NULL", tools.InvoiceOpen, due).
+			WherePK().Update()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimBalanceBatch moves a batch from one of the given states to another, and tells whether it did,
+// so that a batch is only started once.
+func claimBalanceBatch(tx *pg.Tx, id tools.BatchidT, to string, from ...string) (tools.BalanceBatch, error) {
+	batch := tools.BalanceBatch{Id: id}
+	if err := tx.Model(&batch).WherePK().For("UPDATE").Select(); err != nil {
+		if err.Error() == tools.PgNotFoundErr {
+			return batch, errors.New("Batch not found.")
+		}
+		return batch, err
+	}
+	if !batchClaimable(batch, from) {
+		return batch, errors.New("The batch is " + batch.State + ".")
+	}
+	if to == tools.BatchReversing && batch.State != tools.BatchReversing {
+		batch.Done = 0
+	}
+	batch.State = to
+	batch.Error = ""
+	return batch, tx.Update(&batch)
+}
+
+// ApplyBalanceBatch starts applying a draft in the background, or resumes a batch stopped on an error.
+// QueryBalanceBatch shows the progress.
+func ApplyBalanceBatch(commiter tools.Actor, id tools.BatchidT) error {
+	if commiter.Can(tools.PermBalanceBatch) == false {
+		return errors.New("Permission denied.")
+	}
+	err := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		batch, err := claimBalanceBatch(tx, id, tools.BatchRunning, tools.BatchDraft, tools.BatchRunning)
+		if err != nil {
+			return err
+		}
+		return tools.Audit(tx, commiter, "ApplyBalanceBatch", batchTarget(id), nil, batch)
+	})
+	if err == nil {
+		go runBalanceBatch(id)
+	}
+	return err
+}
+
+// ReverseBalanceBatch starts undoing, in the background, every adjustment a batch applied. A batch
+// stopped on an error half-way may be reversed too.
+func ReverseBalanceBatch(commiter tools.Actor, id tools.BatchidT) error {
+	if commiter.Can(tools.PermBalanceBatch) == false {
+		return errors.New("Permission denied.")
+	}
+	err := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		batch, err := claimBalanceBatch(tx, id, tools.BatchReversing, tools.BatchDone, tools.BatchRunning, tools.BatchReversing)
+		if err != nil {
+			return err
+		}
+		return tools.Audit(tx, commiter, "ReverseBalanceBatch", batchTarget(id), nil, batch)
+	})
+	if err == nil {
+		go runBalanceBatch(id)
+	}
+	return err
+}
+
+// DiscardBalanceBatch drops a draft.
+func DiscardBalanceBatch(commiter tools.Actor, id tools.BatchidT) error {
+	if commiter.Can(tools.PermBalanceBatch) == false {
+		return errors.New("Permission denied.")
+	}
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		batch, err := claimBalanceBatch(tx, id, tools.BatchDiscarded, tools.BatchDraft)
+		if err != nil {
+			return err
+		}
+		return tools.Audit(tx, commiter, "DiscardBalanceBatch", batchTarget(id), nil, batch)
+	})
+}
+
+// runBalanceBatchChunk applies, or reverses, the next chunk of a batch. It returns false once the batch
+// is over.
+func runBalanceBatchChunk(id tools.BatchidT) (bool, error) {
+	var changed []tools.UserInfo
+	var before []tools.MoneyT
+	more := false
+	err := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		batch := tools.BalanceBatch{Id: id}
+		if err := tx.Model(&batch).WherePK().For("UPDATE").Select(); err != nil {
+			return err
+		}
+		reversing := batch.State == tools.BatchReversing
+		if (batch.State != tools.BatchRunning && !reversing) || batch.Error != "" {
+			return nil
+		}
+
+		var items []tools.BalanceBatchItem
+		q := tx.Model(&items).Where("batch_id = ?", id)
+		if reversing {
+			q = q.Where("applied AND NOT reversed")
+		} else {
+			q = q.Where("NOT applied")
+		}
+		if err := q.Order("u_id").Limit(BatchChunkSize).Select(); err != nil && err.Error() != tools.PgNotFoundErr {
+			return err
+		}
+		if len(items) == 0 {
+			if reversing {
+				batch.State, batch.ReversedAt = tools.BatchReversed, time.Now()
+			} else {
+				batch.State, batch.AppliedAt = tools.BatchDone, time.Now()
+			}
+			return tx.Update(&batch)
+		}
+
+		for _, item := range items {
+			u, err := lockUser(tx, item.UId)
+			if err != nil {
+				return err
+			}
+			if u.Status == tools.StatusRemoved && !reversing {
+				// Removed since the batch was created: leave the account out.
+				if _, err := tx.Model(&item).WherePK().Delete(); err != nil {
+					return err
+				}
+				batch.Accounts--
+				batch.TotalAmount -= item.Amount
+				continue
+			}
+
+			before = append(before, u.Balance)
+			if reversing {
+				err = applyBatchBalanceChange(tx, &u, -item.Amount, "batch_reversal", fmt.Sprintf("batch %d %s", id, batch.Note), id)
+				if err == nil && item.Amount > 0 {
+					err = reopenSettledInvoices(tx, u, id)
+				}
+				item.Reversed = true
+			} else {
+				err = applyBatchBalanceChange(tx, &u, item.Amount, "batch_adjustment", fmt.Sprintf("batch %d %s", id, batch.Note), id)
+				item.Applied = true
+			}
+			if err != nil {
+				return err
+			}
+			if err := tx.Update(&item); err != nil {
+				return err
+			}
+			changed = append(changed, u)
+			batch.Done++
+		}
+		more = true
+		return tx.Update(&batch)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for i, u := range changed {
+		notifyBalanceChange(u, before[i], "batch_adjustment")
+	}
+	return more, nil
+}
+
+// runBalanceBatch applies or reverses a batch chunk by chunk. An error stops the batch and is recorded.
+func runBalanceBatch(id tools.BatchidT) {
+	for {
+		more, err := runBalanceBatchChunk(id)
+		if err != nil {
+			log.Printf("Balance batch %d stopped. %s", id, err.Error())
+			_, err2 := tools.DB_.Model(&tools.BalanceBatch{Id: id}).Set("error = ?", err.Error()).WherePK().Update()
+			if err2 != nil {
+				log.Printf("Unable to record the error of balance batch %d. %s", id, err2.Error())
+			}
+			return
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+// ResumeBalanceBatches continues the batches a restart interrupted.
+func ResumeBalanceBatches() {
+	var batches []tools.BalanceBatch
+	err := tools.DB_.Model(&batches).Column("id").
+		Where("state IN (?, ?) AND error IS NULL", tools.BatchRunning, tools.BatchReversing).Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		log.Print("Unable to resume balance batches. " + err.Error())
+		return
+	}
+	for _, b := range batches {
+		log.Printf("Resuming balance batch %d...", b.Id)
+		go runBalanceBatch(b.Id)
+	}
+}
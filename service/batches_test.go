@@ -0,0 +1,72 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+)
+
+func TestParseBatchList(t *testing.T) {
+	entries, err := parseBatchList("name,amount\nalice,5.00\nbob\ncarol, -1.50\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Amount != 500 || entries[1].Name != "bob" || entries[1].Amount != 0 ||
+		entries[2].Amount != -150 {
+		t.Errorf("got %+v", entries)
+	}
+
+	for _, bad := range []string{"", "name\n", "alice,1,2\n", "alice\nalice\n", "alice,ten\n", "alice,0\n", "bad name!\n"} {
+		if _, err := parseBatchList(bad); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestBatchSelectorString(t *testing.T) {
+	s := BatchSelector{Plan: "basic", Status: "active", Names: []string{"alice", "bob"}}
+	if got := s.String(); got != "names=alice%2Cbob&plan=basic&status=active" {
+		t.Errorf("got %q", got)
+	}
+	if !(BatchSelector{}).empty() || s.empty() {
+		t.Error("empty")
+	}
+}
+
+func TestBatchClaimable(t *testing.T) {
+	reverse := []string{tools.BatchDone, tools.BatchRunning, tools.BatchReversing}
+	cases := []struct {
+		batch tools.BalanceBatch
+		want  bool
+	}{
+		{tools.BalanceBatch{State: tools.BatchDone}, true},
+		{tools.BalanceBatch{State: tools.BatchRunning}, false},
+		{tools.BalanceBatch{State: tools.BatchRunning, Error: "lost connection"}, true},
+		{tools.BalanceBatch{State: tools.BatchReversing}, false},
+		{tools.BalanceBatch{State: tools.BatchReversing, Error: "lost connection"}, true},
+		{tools.BalanceBatch{State: tools.BatchDraft}, false},
+		{tools.BalanceBatch{State: tools.BatchReversed}, false},
+	}
+	for _, c := range cases {
+		if got := batchClaimable(c.batch, reverse); got != c.want {
+			t.Errorf("%s %q: got %v", c.batch.State, c.batch.Error, got)
+		}
+	}
+}
+
+func TestReopenedDue(t *testing.T) {
+	// The balance still covers the invoice: it stays paid.
+	if got := reopenedDue(1000, 0); got != 0 {
+		t.Errorf("covered: got %d", got)
+	}
+	if got := reopenedDue(1000, 250); got != 0 {
+		t.Errorf("in credit: got %d", got)
+	}
+	// The reversal leaves the customer owing part or all of the invoice again.
+	if got := reopenedDue(1000, -400); got != 400 {
+		t.Errorf("partly: got %d", got)
+	}
+	if got := reopenedDue(1000, -1500); got != 1000 {
+		t.Errorf("fully: got %d", got)
+	}
+}
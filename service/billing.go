@@ -0,0 +1,376 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+)
+
+// How long a postpaid customer has to pay an invoice, and how often the billing worker wakes up.
+var InvoiceDueDays = 14
+var BillingCheckInterval = time.Hour
+
+// lockUser reloads a user inside a transaction so that concurrent balance changes serialize.
+func lockUser(tx *pg.Tx, uid tools.UidT) (tools.UserInfo, error) {
+	u := tools.UserInfo{Id: uid}
+	err := tx.Model(&u).WherePK().For("UPDATE").Select()
+	return u, err
+}
+
+// applyBalanceChange moves the balance of a locked user and writes the ledger entry.
+// Falling below the balance floor suspends the account, and getting back above it reactivates the
+// account and settles its open invoices.
+func applyBalanceChange(tx *pg.Tx, u *tools.UserInfo, delta tools.MoneyT, kind, note string) error {
+	return applyBatchBalanceChange(tx, u, delta, kind, note, 0)
+}
+
+// applyBatchBalanceChange is applyBalanceChange writing a ledger entry of a BalanceBatch.
+func applyBatchBalanceChange(tx *pg.Tx, u *tools.UserInfo, delta tools.MoneyT, kind, note string, batch tools.BatchidT) error {
+	event := tools.UserBalanceEvent{
+		UId: u.Id,
+		What: fmt.Sprintf("%s %s from %s to %s %s",
+			kind, delta.String(), u.Balance.String(), (u.Balance + delta).String(), note),
+		BatchId: batch,
+	}
+	u.Balance += delta
+
+	if err := tx.Insert(&event); err != nil {
+		return err
+	}
+
+	if delta > 0 && u.Balance >= 0 {
+		q := tx.Model(&tools.Invoice{}).
+			Set("state = ?, amount_due = 0, paid_at = ?", tools.InvoicePaid, time.Now()).
+			Where("u_id = ? AND state = ?", u.Id, tools.InvoiceOpen)
+		if batch != 0 {
+			// SET reads the old amount_due.
+			q = q.Set("settled_by_batch = ?, settled_due = amount_due", batch)
+		}
+		_, err := q.Update()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := refreshStatus(tx, u); err != nil {
+		return err
+	}
+	return tx.Update(u)
+}
+
+// billCustomer charges one customer's plan for the period and issues the invoice. It does nothing if
+// the customer has been billed for that period already.
+func billCustomer(uid tools.UidT, period string) error {
+	var u tools.UserInfo
+	before := tools.MoneyT(0)
+	err := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		var err error
+		u, err = lockUser(tx, uid)
+		if err != nil {
+			return err
+		}
+		before = u.Balance
+
+		count, err := tx.Model(&tools.Invoice{}).Where("u_id = ? AND period = ?", uid, period).Count()
+		if err != nil {
+			return err
+		}
+		if count > 0 || u.Plan == 0 {
+			return nil
+		}
+
+		p := tools.PlanInfo{Id: u.Plan}
+		if err := tx.Select(&p); err != nil {
+			return err
+		}
+
+		lines := []tools.InvoiceLine{{Description: "Plan " + p.Name, Amount: p.Price}}
+		discounts, err := promotionLines(tx, u.Id, p)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, discounts...)
+		total := tools.MoneyT(0)
+		for _, line := range lines {
+			total += line.Amount
+		}
+
+		if err := applyBalanceChange(tx, &u, -total, "plan_fee", "for "+period); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		invoice := tools.Invoice{
+			UId:      u.Id,
+			Period:   period,
+			Amount:   total,
+			State:    tools.InvoicePaid,
+			IssuedAt: now,
+			PaidAt:   now,
+		}
+		if u.Balance < 0 {
+			invoice.AmountDue = -u.Balance
+			invoice.State = tools.InvoiceOpen
+			invoice.DueAt = now.AddDate(0, 0, InvoiceDueDays)
+			invoice.PaidAt = time.Time{}
+		}
+		if err := tx.Insert(&invoice); err != nil {
+			return err
+		}
+		if invoice.State == tools.InvoiceOpen {
+			err := tools.EnqueueTemplatedEmail(tx, u, "invoice_issued", map[string]interface{}{
+				"Name":      u.Name,
+				"Period":    period,
+				"Amount":    invoice.Amount.String(),
+				"AmountDue": invoice.AmountDue.String(),
+				"DueDate":   invoice.DueAt.Format("2006-01-02"),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := range lines {
+			lines[i].InvoiceId = invoice.Id
+		}
+		return tx.Insert(&lines)
+	})
+
+	if err == nil && u.Balance != before {
+		notifyBalanceChange(u, before, "plan_fee")
+	}
+	return err
+}
+
+// RunBillingCycle bills every customer with a plan for the given period (YYYY-MM).
+func RunBillingCycle(period string) error {
+	if _, err := time.Parse(tools.BillingPeriodLayout, period); err != nil {
+		return errors.New("Invalid billing period. Use YYYY-MM.")
+	}
+
+	var users []tools.UserInfo
+	err := tools.DB_.Model(&users).Column("id").
+		Where("plan IS NOT NULL AND plan <> 0 AND roles && ARRAY(SELECT role FROM role_grants WHERE permission = ?)", tools.PermCustomer).
+		Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return err
+	}
+
+	for _, u := range users {
+		if err := billCustomer(u.Id, period); err != nil {
+			return fmt.Errorf("Unable to bill uid %d: %s", u.Id, err.Error())
+		}
+	}
+
+	_, err = tools.DB_.Model(&tools.BillingCycle{Period: period, RanAt: time.Now()}).
+		OnConflict("DO NOTHING").Insert()
+	return err
+}
+
+// previousPeriod is the billing period before the one of t. It steps back from the first day of the
+// month, as AddDate(0, -1, 0) on the 31st may land in the same month.
+func previousPeriod(t time.Time) string {
+	first := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	return first.AddDate(0, -1, 0).Format(tools.BillingPeriodLayout)
+}
+
+// RunBillingWorker bills the previous period once it is over. It never returns.
+func RunBillingWorker() {
+	for {
+		period := previousPeriod(time.Now())
+		count, err := tools.DB_.Model(&tools.BillingCycle{}).Where("period = ?", period).Count()
+		if err == nil && count == 0 {
+			log.Printf("Running billing cycle %s...", period)
+			err = RunBillingCycle(period)
+		}
+		if err != nil {
+			log.Print("Billing cycle failed. " + err.Error())
+		}
+		time.Sleep(BillingCheckInterval)
+	}
+}
+
+func TriggerBillingCycle(commiter tools.Actor, period string) error {
+	if commiter.Can(tools.PermBillingRun) == false {
+		return errors.New("Permission denied.")
+	}
+	if err := RunBillingCycle(period); err != nil {
+		return err
+	}
+	return tools.Audit(tools.DB_, commiter, "RunBillingCycle", period, nil, nil)
+}
+
+func SetCreditLimit(commiter tools.Actor, customerUsername, limitStr string) error {
+	if commiter.Can(tools.PermCreditManage) == false {
+		return errors.New("Permission denied.")
+	}
+
+	limit, err := tools.StringToMoneyT(limitStr)
+	if err != nil {
+		return err
+	}
+	if limit < 0 {
+		return errors.New("Credit limit must not be negative.")
+	}
+
+	u, err := tools.UsernameToInfo(customerUsername)
+	if err != nil {
+		return err
+	}
+	if tools.CheckPermission(u.Id, tools.PermCustomer) == false {
+		return errors.New("Only customer can have a credit limit.")
+	}
+
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		u, err := lockUser(tx, u.Id)
+		if err != nil {
+			return err
+		}
+
+		event := tools.UserBalanceEvent{
+			UId:  u.Id,
+			What: fmt.Sprintf("credit_limit from %s to %s by %d", u.CreditLimit.String(), limit.String(), commiter.Uid),
+		}
+		before := map[string]string{"credit_limit": u.CreditLimit.String(), "status": u.Status}
+		u.CreditLimit = limit
+		if err := applyLimitChange(tx, &u, &event); err != nil {
+			return err
+		}
+		return tools.AuditUser(tx, commiter, "SetCreditLimit", u.Id, u.Name,
+			before, map[string]string{"credit_limit": u.CreditLimit.String(), "status": u.Status})
+	})
+}
+
+func SetAccountType(commiter tools.Actor, customerUsername, accountType string) error {
+	if commiter.Can(tools.PermAccountManage) == false {
+		return errors.New("Permission denied.")
+	}
+	if accountType != tools.AccountPrepaid && accountType != tools.AccountPostpaid {
+		return errors.New("Account type must be prepaid or postpaid.")
+	}
+
+	u, err := tools.UsernameToInfo(customerUsername)
+	if err != nil {
+		return err
+	}
+	if tools.CheckPermission(u.Id, tools.PermCustomer) == false {
+		return errors.New("Only customer can have an account type.")
+	}
+
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		u, err := lockUser(tx, u.Id)
+		if err != nil {
+			return err
+		}
+
+		event := tools.UserBalanceEvent{
+			UId:  u.Id,
+			What: fmt.Sprintf("account_type from %s to %s by %d", u.AccountType, accountType, commiter.Uid),
+		}
+		before := map[string]string{"account_type": u.AccountType, "status": u.Status}
+		u.AccountType = accountType
+		if err := applyLimitChange(tx, &u, &event); err != nil {
+			return err
+		}
+		return tools.AuditUser(tx, commiter, "SetAccountType", u.Id, u.Name,
+			before, map[string]string{"account_type": u.AccountType, "status": u.Status})
+	})
+}
+
+// refreshStatus suspends an active user below the balance floor. A suspended account, or one handed
+// to collections, is reactivated once it is back above the floor with no overdue invoice left.
+func refreshStatus(tx *pg.Tx, u *tools.UserInfo) error {
+	if u.Balance < u.BalanceFloor() {
+		if u.Status == tools.StatusActive {
+			u.Status = tools.StatusSuspended
+		}
+		return nil
+	}
+	if u.Status != tools.StatusSuspended && u.Status != tools.StatusCollections {
+		return nil
+	}
+
+	overdue, err := tx.Model(&tools.Invoice{}).
+		Where("u_id = ? AND state = ? AND due_at < ?", u.Id, tools.InvoiceOpen, time.Now()).Count()
+	if err != nil {
+		return err
+	}
+	if overdue == 0 {
+		u.Status = tools.StatusActive
+	}
+	return nil
+}
+
+// applyLimitChange saves a user whose balance floor changed, suspending or reactivating it as needed.
+func applyLimitChange(tx *pg.Tx, u *tools.UserInfo, event *tools.UserBalanceEvent) error {
+	if err := refreshStatus(tx, u); err != nil {
+		return err
+	}
+
+	if err := tx.Update(u); err != nil {
+		return err
+	}
+	return tx.Insert(event)
+}
+
+func QueryInvoices(commiter tools.Actor, usernameToQuery string) (string, error) {
+	u, err := tools.UsernameToInfo(usernameToQuery)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Id != commiter.Uid {
+		if commiter.Can(tools.PermBalanceView) == false {
+			return "", errors.New("Permission denied.")
+		}
+	}
+
+	var invoices []tools.Invoice
+	err = tools.DB_.Model(&invoices).Where("u_id = ?", u.Id).Order("period DESC").Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+
+	result := ""
+	for _, i := range invoices {
+		due := ""
+		if !i.DueAt.IsZero() {
+			due = i.DueAt.Format("2006-01-02")
+		}
+		result += fmt.Sprintf("invoice_id=%d&period=%s&amount=%s&amount_due=%s&due=%s&state=%s\n",
+			i.Id, i.Period, i.Amount.String(), i.AmountDue.String(), due, i.State)
+	}
+	return result, nil
+}
+
+// QueryInvoiceLines shows the lines of an invoice: the plan fee, then the discounts of promotions.
+func QueryInvoiceLines(commiter tools.Actor, id tools.InvoiceidT) (string, error) {
+	invoice := tools.Invoice{Id: id}
+	if err := tools.DB_.Select(&invoice); err != nil {
+		if err.Error() == tools.PgNotFoundErr {
+			return "", errors.New("Invoice not found.")
+		}
+		return "", err
+	}
+	if invoice.UId != commiter.Uid {
+		if commiter.Can(tools.PermBalanceView) == false {
+			return "", errors.New("Permission denied.")
+		}
+	}
+
+	var lines []tools.InvoiceLine
+	err := tools.DB_.Model(&lines).Where("invoice_id = ?", id).Order("id").Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+	result := ""
+	for _, line := range lines {
+		result += fmt.Sprintf("description=%s&amount=%s\n", url.QueryEscape(line.Description), line.Amount.String())
+	}
+	return result, nil
+}
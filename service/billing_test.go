@@ -0,0 +1,19 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPreviousPeriod(t *testing.T) {
+	cases := map[string]string{
+		"2026-03-29": "2026-02", "2026-03-30": "2026-02", "2026-03-31": "2026-02",
+		"2026-05-31": "2026-04", "2026-12-31": "2026-11", "2026-01-31": "2025-12", "2026-07-01": "2026-06",
+	}
+	for day, want := range cases {
+		d, _ := time.ParseInLocation("2006-01-02", day, time.Local)
+		if got := previousPeriod(d.Add(23 * time.Hour)); got != want {
+			t.Errorf("%s: got %s, want %s", day, got, want)
+		}
+	}
+}
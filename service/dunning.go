@@ -0,0 +1,257 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+)
+
+// DayOffsets is a comma-separated list of days after an invoice's due date, usable as a flag.
+type DayOffsets []int
+
+func (d DayOffsets) String() string {
+	strs := make([]string, len(d))
+	for i, day := range d {
+		strs[i] = strconv.Itoa(day)
+	}
+	return strings.Join(strs, ",")
+}
+
+func (d *DayOffsets) Set(s string) error {
+	var days []int
+	for _, str := range strings.Split(s, ",") {
+		if strings.TrimSpace(str) == "" {
+			continue
+		}
+		day, err := strconv.Atoi(strings.TrimSpace(str))
+		if err != nil || day < 0 {
+			return errors.New("Invalid day offset: " + str)
+		}
+		days = append(days, day)
+	}
+	*d = days
+	return nil
+}
+
+// The dunning policy. A negative day count disables its step.
+var DunningReminderDays = DayOffsets{1, 7, 14}
+var LateFeeDays = 10
+var LateFee = tools.MoneyT(500)
+var DunningSuspendDays = 21
+var DunningCollectionsDays = 60
+var DunningCheckInterval = time.Hour
+
+type dunningAction struct {
+	Step   string
+	Offset int
+}
+
+func (a dunningAction) key() string {
+	return a.Step + "@" + strconv.Itoa(a.Offset)
+}
+
+// dunningSchedule lists the configured actions ordered by offset.
+func dunningSchedule() []dunningAction {
+	var schedule []dunningAction
+	for _, day := range DunningReminderDays {
+		schedule = append(schedule, dunningAction{tools.DunningReminder, day})
+	}
+	if LateFeeDays >= 0 && LateFee > 0 {
+		schedule = append(schedule, dunningAction{tools.DunningLateFee, LateFeeDays})
+	}
+	if DunningSuspendDays >= 0 {
+		schedule = append(schedule, dunningAction{tools.DunningSuspension, DunningSuspendDays})
+	}
+	if DunningCollectionsDays >= 0 {
+		schedule = append(schedule, dunningAction{tools.DunningCollections, DunningCollectionsDays})
+	}
+	sort.SliceStable(schedule, func(i, j int) bool { return schedule[i].Offset < schedule[j].Offset })
+	return schedule
+}
+
+// dueDunningActions returns the actions of the schedule that are due and not taken yet. When several
+// reminders are due at once, after downtime or on first deploy, only the latest is due and the earlier
+// ones are returned as skipped.
+func dueDunningActions(schedule []dunningAction, daysOverdue int, done map[string]bool) (due, skipped []dunningAction) {
+	lastReminder := -1
+	for _, action := range schedule {
+		if action.Offset > daysOverdue || done[action.key()] {
+			continue
+		}
+		if action.Step == tools.DunningReminder {
+			if lastReminder >= 0 {
+				skipped = append(skipped, due[lastReminder])
+				due = append(due[:lastReminder], due[lastReminder+1:]...)
+			}
+			lastReminder = len(due)
+		}
+		due = append(due, action)
+	}
+	return due, skipped
+}
+
+// skipDunningAction records a step as taken without performing it, so that it is never taken later.
+func skipDunningAction(invoice tools.Invoice, action dunningAction, daysOverdue int) error {
+	return tools.DB_.Insert(&tools.DunningStep{
+		UId:         invoice.UId,
+		InvoiceId:   invoice.Id,
+		Step:        action.Step,
+		Offset:      action.Offset,
+		DaysOverdue: daysOverdue,
+		Time:        time.Now(),
+		Note:        "skipped, superseded by a later reminder",
+	})
+}
+
+// takeDunningAction records and performs one step on an overdue invoice.
+func takeDunningAction(invoice tools.Invoice, action dunningAction, daysOverdue int) error {
+	var u tools.UserInfo
+	before := tools.MoneyT(0)
+	err := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		var err error
+		u, err = lockUser(tx, invoice.UId)
+		if err != nil {
+			return err
+		}
+		before = u.Balance
+
+		step := tools.DunningStep{
+			UId:         u.Id,
+			InvoiceId:   invoice.Id,
+			Step:        action.Step,
+			Offset:      action.Offset,
+			DaysOverdue: daysOverdue,
+			Time:        time.Now(),
+		}
+
+		switch action.Step {
+		case tools.DunningReminder:
+			err := tools.EnqueueTemplatedEmail(tx, u, "payment_reminder", map[string]interface{}{
+				"Name":        u.Name,
+				"Period":      invoice.Period,
+				"DaysOverdue": daysOverdue,
+				"AmountDue":   invoice.AmountDue.String(),
+			})
+			if err != nil {
+				return err
+			}
+			step.Note = "reminder sent to " + u.Email
+		case tools.DunningLateFee:
+			note := fmt.Sprintf("for invoice %d", invoice.Id)
+			if err := applyBalanceChange(tx, &u, -LateFee, "late_fee", note); err != nil {
+				return err
+			}
+			line := tools.InvoiceLine{InvoiceId: invoice.Id, Description: "Late fee", Amount: LateFee}
+			if err := tx.Insert(&line); err != nil {
+				return err
+			}
+			_, err := tx.Model(&tools.Invoice{}).
+				Set("amount = amount + ?, amount_due = amount_due + ?", LateFee, LateFee).
+				Where("id = ?", invoice.Id).Update()
+			if err != nil {
+				return err
+			}
+			step.Note = "late fee " + LateFee.String()
+		case tools.DunningSuspension:
+			if u.Status == tools.StatusActive {
+				u.Status = tools.StatusSuspended
+			}
+			step.Note = "account " + u.Status
+		case tools.DunningCollections:
+			u.Status = tools.StatusCollections
+			step.Note = "handed to collections"
+		}
+
+		if err := tx.Update(&u); err != nil {
+			return err
+		}
+		return tx.Insert(&step)
+	})
+
+	if err == nil && u.Balance != before {
+		notifyBalanceChange(u, before, "late_fee")
+	}
+	return err
+}
+
+// RunDunning walks all overdue invoices once and takes the actions that became due.
+func RunDunning() error {
+	now := time.Now()
+	var invoices []tools.Invoice
+	err := tools.DB_.Model(&invoices).Where("state = ? AND due_at < ?", tools.InvoiceOpen, now).
+		Where("u_id NOT IN (SELECT id FROM user_infos WHERE status = ?)", tools.StatusRemoved).
+		Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return err
+	}
+
+	schedule := dunningSchedule()
+	for _, invoice := range invoices {
+		var steps []tools.DunningStep
+		err := tools.DB_.Model(&steps).Where("invoice_id = ?", invoice.Id).Select()
+		if err != nil && err.Error() != tools.PgNotFoundErr {
+			return err
+		}
+		done := make(map[string]bool)
+		for _, step := range steps {
+			done[dunningAction{step.Step, step.Offset}.key()] = true
+		}
+
+		daysOverdue := int(now.Sub(invoice.DueAt).Hours() / 24)
+		due, skipped := dueDunningActions(schedule, daysOverdue, done)
+		for _, action := range skipped {
+			if err := skipDunningAction(invoice, action, daysOverdue); err != nil {
+				return fmt.Errorf("Dunning %s on invoice %d failed: %s", action.key(), invoice.Id, err.Error())
+			}
+		}
+		for _, action := range due {
+			if err := takeDunningAction(invoice, action, daysOverdue); err != nil {
+				return fmt.Errorf("Dunning %s on invoice %d failed: %s", action.key(), invoice.Id, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// RunDunningWorker runs the dunning process periodically. It never returns.
+func RunDunningWorker() {
+	for {
+		if err := RunDunning(); err != nil {
+			log.Print("Dunning failed. " + err.Error())
+		}
+		time.Sleep(DunningCheckInterval)
+	}
+}
+
+func QueryDunningStatus(commiter tools.Actor, usernameToQuery string) (string, error) {
+	u, err := tools.UsernameToInfo(usernameToQuery)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Id != commiter.Uid {
+		if commiter.Can(tools.PermBalanceView) == false {
+			return "", errors.New("Permission denied.")
+		}
+	}
+
+	var steps []tools.DunningStep
+	err = tools.DB_.Model(&steps).Where("u_id = ?", u.Id).Order("time").Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+
+	result := "status=" + u.Status + "\n"
+	for _, step := range steps {
+		result += fmt.Sprintf("invoice_id=%d&step=%s&days_overdue=%d&time=%s&note=%s\n",
+			step.InvoiceId, step.Step, step.DaysOverdue, step.Time.Format(time.RFC3339), step.Note)
+	}
+	return result, nil
+}
@@ -0,0 +1,38 @@
+package service
+
+import "testing"
+
+func TestDueDunningActions(t *testing.T) {
+	schedule := []dunningAction{
+		{"reminder", 1}, {"reminder", 7}, {"late_fee", 10}, {"suspension", 21}, {"collections", 60},
+	}
+
+	if due, skipped := dueDunningActions(schedule, 0, map[string]bool{}); len(due)+len(skipped) != 0 {
+		t.Error("nothing should be due on the due date")
+	}
+
+	due, skipped := dueDunningActions(schedule, 12, map[string]bool{"reminder@1": true})
+	if len(due) != 2 || len(skipped) != 0 || due[0].key() != "reminder@7" || due[1].key() != "late_fee@10" {
+		t.Error("due dunning actions boom")
+	}
+
+	due, skipped = dueDunningActions(schedule, 100, map[string]bool{})
+	if len(due)+len(skipped) != len(schedule) || len(skipped) != 1 || skipped[0].key() != "reminder@1" {
+		t.Error("every action should be due in the end, the first reminder skipped")
+	}
+
+	due, skipped = dueDunningActions(schedule, 8, map[string]bool{})
+	if len(due) != 1 || due[0].key() != "reminder@7" || len(skipped) != 1 || skipped[0].key() != "reminder@1" {
+		t.Errorf("only the latest reminder should be sent: %+v, skipped %+v", due, skipped)
+	}
+}
+
+func TestDayOffsets(t *testing.T) {
+	var days DayOffsets
+	if err := days.Set("1, 7,14"); err != nil || days.String() != "1,7,14" {
+		t.Error("day offsets boom: " + days.String())
+	}
+	if err := days.Set("1,x"); err == nil {
+		t.Error("bad day offset accepted")
+	}
+}
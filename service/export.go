@@ -0,0 +1,253 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// The files of a personal data export, each a JSON document.
+type exportedUser struct {
+	Name        string   `json:"name"`
+	Email       string   `json:"email"`
+	Roles       []string `json:"roles"`
+	Language    string   `json:"language"`
+	AccountType string   `json:"account_type"`
+	CreditLimit string   `json:"credit_limit"`
+	Status      string   `json:"status"`
+	Balance     string   `json:"balance"`
+	Plan        string   `json:"plan"`
+	PlanPrice   string   `json:"plan_price"`
+	Number      string   `json:"number"`
+	Sim         string   `json:"sim"`
+	TotpEnabled bool     `json:"totp_enabled"`
+}
+
+type exportedPlanChange struct {
+	Time     time.Time `json:"time"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	NewPrice string    `json:"new_price"`
+}
+
+type exportedInvoice struct {
+	Id        tools.InvoiceidT      `json:"id"`
+	Period    string                `json:"period"`
+	Amount    string                `json:"amount"`
+	AmountDue string                `json:"amount_due"`
+	State     string                `json:"state"`
+	IssuedAt  time.Time             `json:"issued_at"`
+	DueAt     time.Time             `json:"due_at"`
+	PaidAt    *time.Time            `json:"paid_at"`
+	Lines     []exportedInvoiceLine `json:"lines"`
+}
+
+type exportedInvoiceLine struct {
+	Description string `json:"description"`
+	Amount      string `json:"amount"`
+}
+
+type exportedNotification struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Channel string    `json:"channel"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type exportedAuditEntry struct {
+	Time      time.Time       `json:"time"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	SourceIp  string          `json:"ip,omitempty"`
+	UserAgent string          `json:"user_agent,omitempty"`
+}
+
+// legacyUserAuditActions are the actions whose target is a user name, for the entries without a target uid.
+var legacyUserAuditActions = []string{"SetUserRoles", "StartImpersonation", "StopImpersonation", "ImpersonatedCall",
+	"EnableTotp", "DisableTotp", "RevokeSession", "LogoutEverywhere", "PairSim", "SwapSim", "ReportSimLost", "AddUser",
+	"RemoveUser", "UnlockUser", "UpdateUserPlan", "UpdateUserBalance", "AnonymizeUser", "SetCreditLimit",
+	"SetAccountType", "UpdateProfile", "ExportPersonalData"}
+
+// rawJSON keeps an audit snapshot as JSON in the export rather than as a string of JSON.
+func rawJSON(s string) json.RawMessage {
+	if s == "" {
+		return nil
+	}
+	return json.RawMessage(s)
+}
+
+// zipJSON writes each document as an indented JSON file of a zip archive, in the given order.
+func zipJSON(names []string, docs map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range names {
+		f, err := w.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(docs[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ExportPersonalData collects everything held about a user into a zip of JSON files. Customers export
+// their own data, customer service the data of any customer. Every export is audited.
+func ExportPersonalData(commiter tools.Actor, username string) ([]byte, error) {
+	u, err := tools.UsernameToInfo(username)
+	if err != nil {
+		return nil, err
+	}
+	if u.Id != commiter.Uid {
+		if commiter.Can(tools.PermDataExport) == false || tools.CheckPermission(u.Id, tools.PermCustomer) == false {
+			return nil, errors.New("Permission denied.")
+		}
+	}
+
+	plan := tools.PlanInfo{Id: u.Plan}
+	if u.Plan != 0 {
+		if err := tools.DB_.Select(&plan); err != nil {
+			return nil, err
+		}
+	}
+	number, err := assignedNumberOf(u.Id)
+	if err != nil {
+		return nil, err
+	}
+	sim, err := activeSimOf(u.Id)
+	if err != nil {
+		return nil, err
+	}
+	user := exportedUser{Name: u.Name, Email: u.Email, Roles: u.Roles, Language: u.Language, AccountType: u.AccountType,
+		CreditLimit: u.CreditLimit.String(), Status: u.Status, Balance: u.Balance.String(), Plan: plan.Name,
+		PlanPrice: plan.Price.String(), Number: number, Sim: sim, TotpEnabled: u.TotpEnabled}
+
+	p, err := tools.ProfileOf(u.Id)
+	if err != nil {
+		return nil, err
+	}
+	profile := make(map[string]string)
+	for _, field := range tools.ProfileFields {
+		profile[field] = p.Get(field)
+	}
+
+	var events []tools.UserBalanceEvent
+	err = tools.DB_.Model(&events).Where("u_id = ?", u.Id).Order("event_id").Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return nil, err
+	}
+	ledger := make([]string, len(events))
+	for i, event := range events {
+		ledger[i] = event.What
+	}
+
+	var invoices []tools.Invoice
+	err = tools.DB_.Model(&invoices).Where("u_id = ?", u.Id).Order("period").Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return nil, err
+	}
+	exportedInvoices := make([]exportedInvoice, len(invoices))
+	for i, invoice := range invoices {
+		var lines []tools.InvoiceLine
+		err = tools.DB_.Model(&lines).Where("invoice_id = ?", invoice.Id).Order("id").Select()
+		if err != nil && err.Error() != tools.PgNotFoundErr {
+			return nil, err
+		}
+		e := exportedInvoice{Id: invoice.Id, Period: invoice.Period, Amount: invoice.Amount.String(),
+			AmountDue: invoice.AmountDue.String(), State: invoice.State, IssuedAt: invoice.IssuedAt, DueAt: invoice.DueAt,
+			Lines: make([]exportedInvoiceLine, len(lines))}
+		if !invoice.PaidAt.IsZero() {
+			paidAt := invoice.PaidAt
+			e.PaidAt = &paidAt
+		}
+		for j, line := range lines {
+			e.Lines[j] = exportedInvoiceLine{Description: line.Description, Amount: line.Amount.String()}
+		}
+		exportedInvoices[i] = e
+	}
+
+	var notifications []tools.Notification
+	err = tools.DB_.Model(&notifications).Where("u_id = ?", u.Id).Order("id").Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return nil, err
+	}
+	exportedNotifications := make([]exportedNotification, len(notifications))
+	for i, n := range notifications {
+		exportedNotifications[i] = exportedNotification{Time: n.Time, Type: n.Type, Channel: n.Channel,
+			Subject: n.Subject, Body: n.Body, Error: n.Error}
+	}
+
+	// The audit entries about the user, and those of the user's own operations. Entries written before
+	// target uids were recorded are matched by name, unless an earlier holder of the name was removed.
+	reused, err := tools.DB_.Model(&tools.AuditEntry{}).
+		Where("action = 'RemoveUser' AND target = ? AND target_uid IS DISTINCT FROM ?", u.Name, u.Id).Count()
+	if err != nil {
+		return nil, err
+	}
+	var entries []tools.AuditEntry
+	q := tools.DB_.Model(&entries).WhereGroup(func(q *orm.Query) (*orm.Query, error) {
+		q = q.WhereOr("target_uid = ?", u.Id).WhereOr("actor_uid = ?", u.Id)
+		if reused == 0 {
+			q = q.WhereOr("target_uid IS NULL AND target = ? AND action IN (?)", u.Name, pg.In(legacyUserAuditActions))
+		}
+		return q, nil
+	})
+	err = q.Order("id").Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return nil, err
+	}
+	audit := make([]exportedAuditEntry, len(entries))
+	planHistory := []exportedPlanChange{}
+	for i, e := range entries {
+		audit[i] = exportedAuditEntry{Time: e.Time, Actor: "staff", Action: e.Action, Target: e.Target,
+			Before: rawJSON(e.Before), After: rawJSON(e.After)}
+		// Where the staff worked from is theirs, not the customer's.
+		if e.ActorUid == u.Id {
+			audit[i].Actor, audit[i].SourceIp, audit[i].UserAgent = u.Name, e.SourceIp, e.UserAgent
+		}
+		if e.Action == "UpdateUserPlan" && (e.TargetUid == u.Id || e.TargetUid == 0 && e.Target == u.Name) {
+			var from, to tools.PlanInfo
+			_ = json.Unmarshal([]byte(e.Before), &from)
+			_ = json.Unmarshal([]byte(e.After), &to)
+			planHistory = append(planHistory, exportedPlanChange{Time: e.Time, From: from.Name, To: to.Name,
+				NewPrice: to.Price.String()})
+		}
+	}
+
+	files := []string{"user.json", "profile.json", "plan_history.json", "balance_log.json", "invoices.json",
+		"notifications.json", "audit_log.json"}
+	archive, err := zipJSON(files, map[string]interface{}{
+		"user.json":          user,
+		"profile.json":       profile,
+		"plan_history.json":  planHistory,
+		"balance_log.json":   ledger,
+		"invoices.json":      exportedInvoices,
+		"notifications.json": exportedNotifications,
+		"audit_log.json":     audit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tools.AuditUser(tools.DB_, commiter, "ExportPersonalData", u.Id, u.Name, nil, map[string]interface{}{
+		"files": files, "bytes": len(archive),
+	})
+	return archive, err
+}
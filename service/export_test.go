@@ -0,0 +1,43 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func TestZipJSON(t *testing.T) {
+	archive, err := zipJSON([]string{"a.json", "b.json"}, map[string]interface{}{
+		"a.json": map[string]string{"name": "bob"},
+		"b.json": []exportedAuditEntry{{Action: "AddUser", After: rawJSON(`{"Id":1}`), Before: rawJSON("")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != 2 || r.File[0].Name != "a.json" || r.File[1].Name != "b.json" {
+		t.Fatalf("unexpected files %v", r.File)
+	}
+
+	f, err := r.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(f)
+	var entries []map[string]interface{}
+	if err := json.Unmarshal(content, &entries); err != nil {
+		t.Fatal(err)
+	}
+	after, ok := entries[0]["after"].(map[string]interface{})
+	if !ok || after["Id"] != float64(1) {
+		t.Errorf("snapshot not embedded as JSON: %s", content)
+	}
+	if _, ok := entries[0]["before"]; ok {
+		t.Errorf("empty snapshot exported: %s", content)
+	}
+}
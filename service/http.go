@@ -3,7 +3,11 @@ package service
 import (
 	"github.com/Chips-zhang/DBProjectHust/tools"
 
+	"errors"
+	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -11,8 +15,55 @@ import (
 	"time"
 )
 
+// safeMethods change nothing and may be called with GET. Every other method requires POST, so that
+// links and images on other sites cannot call it.
+var safeMethods = map[string]bool{
+	"QueryUserInfo": true, "QueryBalanceLog": true, "ListAllUserInfo": true, "ListAllPlanInfo": true,
+	"SearchAvailableNumbers": true, "QueryInvoices": true, "QueryDunningStatus": true,
+	"QueryNotificationSettings": true, "ListOutboxEmails": true, "ListRoles": true, "ListApiKeys": true,
+	"ListSessions": true, "QueryAuditLog": true, "ExportAuditLog": true, "SearchUsers": true,
+	"QueryProfile": true, "ListBalanceBatches": true, "QueryBalanceBatch": true,
+	"QueryInvoiceLines": true, "ListPromotions": true, "ListRedemptions": true,
+}
+
+// MaxUploadBytes bounds the files uploaded as the body of a request, such as user imports.
+var MaxUploadBytes int64 = 10 << 20
+
+// readUpload reads a file uploaded as the request body. Form bodies are refused, as ParseForm has
+// consumed them already.
+func readUpload(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/x-www-form-urlencoded" {
+		return nil, errors.New("Send the file as the request body, not as a form.")
+	}
+	return ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxUploadBytes))
+}
+
+// SecureCookies marks the session cookies Secure even on requests that do not look like HTTPS.
+var SecureCookies = false
+
+// CookieMaxAge is how long browsers keep the session cookies. The session may end sooner, see tools.SessionMaxAge.
+var CookieMaxAge = 7 * 24 * time.Hour
+
+// Per-IP limits of the methods that check a password or send emails.
+var LoginRateLimit = tools.NewRateLimiter(10, 6*time.Second)
+var ForgetPasswordRateLimit = tools.NewRateLimiter(3, 5*time.Minute)
+
 func HttpApiFunc(w http.ResponseWriter, r *http.Request) {
-	status, response := httpApiFuncImpl(w, r)
+	if r.Method != http.MethodPost && !(r.Method == http.MethodGet && safeMethods[apiMethodOf(r)]) {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(405)
+		_, _ = w.Write([]byte("Method not allowed. Use POST."))
+		return
+	}
+
+	r, status, response := authenticate(r)
+	if commiter := tools.ActorFrom(r.Context()); commiter.Impersonator != 0 {
+		// Pages show a banner, and scripts can tell, that the response is not the customer's own.
+		w.Header().Set("X-Impersonated-By", strconv.FormatInt(int64(commiter.Impersonator), 10))
+	}
+	if status == 200 {
+		status, response = httpApiFuncImpl(w, r)
+	}
 	w.WriteHeader(status)
 	_, _ = w.Write([]byte(response))
 	return
@@ -27,48 +78,175 @@ func apiExistArgs(apiArgs url.Values, required ...string) (string, bool) {
 	return "", true
 }
 
-func httpApiFuncImpl(w http.ResponseWriter, r *http.Request) (int, string) {
-	uri := r.RequestURI
-	apiMethod := strings.Split(uri, "?")[0][1:]
-	apiArgs := r.URL.Query()
+// clientIp is the address of the client. Requests relayed by the local nginx carry it as the last
+// X-Forwarded-For entry, which nginx appends itself.
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			hops := strings.Split(forwarded, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	return host
+}
 
-	log.Printf("API %s", apiMethod)
+// isHttps tells whether the client connected with TLS, to us or to the local nginx.
+func isHttps(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback() && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// setSessionCookies gives the browser the session token, out of reach of scripts, and the CSRF token
+// that pages send back in the X-Csrf-Token header.
+func setSessionCookies(w http.ResponseWriter, r *http.Request, token string) {
+	secure := SecureCookies || isHttps(r)
+	expires := time.Now().Add(CookieMaxAge)
+	http.SetCookie(w, &http.Cookie{Name: "token", Value: token, Path: "/", Expires: expires,
+		HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode})
+	http.SetCookie(w, &http.Cookie{Name: "csrf_token", Value: tools.CsrfToken(token), Path: "/", Expires: expires,
+		Secure: secure, SameSite: http.SameSiteStrictMode})
+}
 
-	commiterUid := tools.UidT(-1)
+func clearSessionCookies(w http.ResponseWriter, r *http.Request) {
+	secure := SecureCookies || isHttps(r)
+	http.SetCookie(w, &http.Cookie{Name: "token", Path: "/", MaxAge: -1, HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode})
+	http.SetCookie(w, &http.Cookie{Name: "csrf_token", Path: "/", MaxAge: -1, Secure: secure, SameSite: http.SameSiteStrictMode})
+}
+
+func apiMethodOf(r *http.Request) string {
+	return strings.Split(r.RequestURI, "?")[0][1:]
+}
+
+// requestToken returns the session token of a request, and whether it came from the cookie.
+// Scripts pass the token as an argument instead.
+func requestToken(r *http.Request) (string, bool) {
+	if val, ok := r.URL.Query()["token"]; ok {
+		return val[0], false
+	}
 	token := ""
-	if apiMethod != "Login" && apiMethod != "ForgetPassword" && apiMethod != "ChangePassword" {
-		// Login don't need token.
-		if val, ok := apiArgs["token"]; ok {
-			token = val[0]
-		} else {
-			for _, cookie := range r.Cookies() {
-				if cookie.Name == "token" {
-					token = cookie.Value
-				}
-			}
+	for _, cookie := range r.Cookies() {
+		if cookie.Name == "token" {
+			token = cookie.Value
 		}
+	}
+	return token, token != ""
+}
+
+// authenticate resolves the principal of a request, with its permissions, once and carries it in the
+// request context. Services authenticate with an API key in the X-Api-Key header instead of a token.
+// The methods that need no token run as an anonymous actor.
+func authenticate(r *http.Request) (*http.Request, int, string) {
+	apiMethod := apiMethodOf(r)
+	commiter := tools.Actor{Uid: -1, Ip: clientIp(r), UserAgent: r.UserAgent()}
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		k, grants, err := tools.VerifyApiKey(key, commiter.Ip)
+		if err != nil {
+			return r, 403, "Invalid API key. " + err.Error()
+		}
+		commiter.Uid = k.OwnerUid
+		commiter.Grants = grants
+		commiter.ApiKey = k.Name
+	} else if apiMethod != "Login" && apiMethod != "LoginTotp" && apiMethod != "ForgetPassword" && apiMethod != "ChangePassword" {
+		// Login don't need token.
+		token, fromCookie := requestToken(r)
 		if token == "" {
-			return 403, "Missing token."
+			return r, 403, "Missing token."
+		}
+		// Browsers send the cookie along with requests made by any site. Only our pages know the CSRF token.
+		if fromCookie && !safeMethods[apiMethod] && !tools.CheckCsrfToken(token, r.Header.Get("X-Csrf-Token")) {
+			return r, 403, "Missing or invalid CSRF token. Reload the page."
 		}
 
-		uid, err := tools.VerifyToken(token)
+		session, err := tools.VerifyToken(token, commiter.Ip)
+		if err != nil {
+			return r, 403, "Invalid token. " + err.Error()
+		}
+		grants, err := tools.UserGrants(session.Uid)
 		if err != nil {
-			return 403, "Invalid token. " + err.Error()
+			return r, 403, "Invalid token. " + err.Error()
+		}
+		commiter.Uid = session.Uid
+		commiter.Grants = grants
+		commiter.Session = session.Id
+		commiter.Impersonator = session.Impersonator
+
+		if session.Impersonator != 0 {
+			// Impersonation only shows what the customer sees: no password change, no money moved, nothing.
+			if !safeMethods[apiMethod] && apiMethod != "StopImpersonation" && apiMethod != "Logout" {
+				return r.WithContext(tools.WithActor(r.Context(), commiter)), 403, "This is a read-only impersonation session."
+			}
+			if err := r.ParseForm(); err != nil {
+				return r, 400, "Unable to parse arguments. " + err.Error()
+			}
+			if err := auditImpersonatedCall(commiter, session.UserName, apiMethod, r.Form); err != nil {
+				return r, 500, "Server API error: " + err.Error()
+			}
 		}
-		commiterUid = uid
 	}
+	return r.WithContext(tools.WithActor(r.Context(), commiter)), 200, ""
+}
+
+func httpApiFuncImpl(w http.ResponseWriter, r *http.Request) (int, string) {
+	apiMethod := apiMethodOf(r)
+	if err := r.ParseForm(); err != nil {
+		return 400, "Unable to parse arguments. " + err.Error()
+	}
+	// Arguments come in the query string or, for POST, in a form body.
+	apiArgs := r.Form
+
+	log.Printf("API %s", apiMethod)
+
+	commiter := tools.ActorFrom(r.Context())
+	token, _ := requestToken(r)
 
 	switch apiMethod {
 	case "Login":
 		if lack, ok := apiExistArgs(apiArgs, "name", "password"); !ok {
 			return 400, "Required argument '" + lack + "' not defined."
 		}
-		token, err := tools.DoLogin(apiArgs["name"][0], apiArgs["password"][0])
+		if !LoginRateLimit.Allow(commiter.Ip) {
+			return 429, "Too many attempts. Try again later."
+		}
+		step, err := tools.DoLogin(commiter, apiArgs["name"][0], apiArgs["password"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else if step.Challenge != "" {
+			// The second factor is still to come, see LoginTotp.
+			if step.Secret != "" {
+				return 200, "challenge=" + step.Challenge + "&secret=" + step.Secret +
+					"&url=" + url.QueryEscape(tools.TotpUrl(apiArgs["name"][0], step.Secret))
+			}
+			return 200, "challenge=" + step.Challenge
+		} else {
+			setSessionCookies(w, r, step.Token)
+			return 200, "token=" + step.Token
+		}
+	case "LoginTotp":
+		if lack, ok := apiExistArgs(apiArgs, "challenge", "code"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		if !LoginRateLimit.Allow(commiter.Ip) {
+			return 429, "Too many attempts. Try again later."
+		}
+		token, recoveryCodes, err := tools.DoLoginTotp(commiter, apiArgs["challenge"][0], apiArgs["code"][0])
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
-			newCookie := http.Cookie{Name: "token", Value: token}
-			http.SetCookie(w, &newCookie)
+			setSessionCookies(w, r, token)
+			if recoveryCodes != nil {
+				return 200, "token=" + token + "&recovery_codes=" + strings.Join(recoveryCodes, ",")
+			}
 			return 200, "token=" + token
 		}
 	case "Logout":
@@ -76,15 +254,70 @@ func httpApiFuncImpl(w http.ResponseWriter, r *http.Request) (int, string) {
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
-			newCookie := http.Cookie{Name: "token", Value: token, Expires: time.Now()}
-			http.SetCookie(w, &newCookie)
+			clearSessionCookies(w, r)
+			return 200, "status=ok"
+		}
+	case "ListSessions":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		content, err := ListSessions(commiter, apiArgs["name"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "RevokeSession":
+		if lack, ok := apiExistArgs(apiArgs, "name", "id"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := RevokeSession(commiter, apiArgs["name"][0], apiArgs["id"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "LogoutEverywhere":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := LogoutEverywhere(commiter, apiArgs["name"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			if _, err := tools.VerifyToken(token, commiter.Ip); err != nil {
+				// The session of this request is gone too.
+				clearSessionCookies(w, r)
+			}
+			return 200, "status=ok"
+		}
+	case "StartImpersonation":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		newToken, session, err := StartImpersonation(commiter, token, apiArgs["name"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			setSessionCookies(w, r, newToken)
+			return 200, "token=" + newToken + "&name=" + session.UserName + "&until=" + session.Until.Format(time.RFC3339)
+		}
+	case "StopImpersonation":
+		parent, err := StopImpersonation(commiter, token)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else if parent == "" {
+			clearSessionCookies(w, r)
+			return 200, "status=ok"
+		} else {
+			setSessionCookies(w, r, parent)
 			return 200, "status=ok"
 		}
 	case "AddUser":
 		if lack, ok := apiExistArgs(apiArgs, "name", "password", "role", "email"); !ok {
 			return 400, "Required argument '" + lack + "' not defined."
 		}
-		uid, err := AddUser(commiterUid, apiArgs["name"][0], apiArgs["password"][0], apiArgs["role"][0], apiArgs["email"][0])
+		uid, err := AddUser(commiter, apiArgs["name"][0], apiArgs["password"][0], apiArgs["role"][0], apiArgs["email"][0], apiArgs.Get("number"))
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
@@ -94,7 +327,24 @@ func httpApiFuncImpl(w http.ResponseWriter, r *http.Request) (int, string) {
 		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
 			return 400, "Required argument '" + lack + "' not defined."
 		}
-		err := RemoveUser(commiterUid, apiArgs["name"][0])
+		freeName := false
+		if s := apiArgs.Get("free_name"); s != "" {
+			var err error
+			if freeName, err = strconv.ParseBool(s); err != nil {
+				return 400, "Argument 'free_name' must be true or false."
+			}
+		}
+		err := RemoveUser(commiter, apiArgs["name"][0], freeName)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "UnlockUser":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := UnlockUser(commiter, apiArgs["name"][0])
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
@@ -104,7 +354,7 @@ func httpApiFuncImpl(w http.ResponseWriter, r *http.Request) (int, string) {
 		if lack, ok := apiExistArgs(apiArgs, "plan_name", "price"); !ok {
 			return 400, "Required argument '" + lack + "' not defined."
 		}
-		planId, err := AddPlan(commiterUid, apiArgs["plan_name"][0], apiArgs["price"][0])
+		planId, err := AddPlan(commiter, apiArgs["plan_name"][0], apiArgs["price"][0])
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
@@ -114,7 +364,7 @@ func httpApiFuncImpl(w http.ResponseWriter, r *http.Request) (int, string) {
 		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
 			return 400, "Required argument '" + lack + "' not defined."
 		}
-		err := RemovePlan(commiterUid, apiArgs["name"][0])
+		err := RemovePlan(commiter, apiArgs["name"][0])
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
@@ -125,7 +375,7 @@ func httpApiFuncImpl(w http.ResponseWriter, r *http.Request) (int, string) {
 		if lack, ok := apiExistArgs(apiArgs, "plan_name", "name"); !ok {
 			return 400, "Required argument '" + lack + "' not defined."
 		}
-		err := UpdateUserPlan(commiterUid, apiArgs["name"][0], apiArgs["plan_name"][0])
+		err := UpdateUserPlan(commiter, apiArgs["name"][0], apiArgs["plan_name"][0])
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
@@ -135,7 +385,7 @@ func httpApiFuncImpl(w http.ResponseWriter, r *http.Request) (int, string) {
 		if lack, ok := apiExistArgs(apiArgs, "delta", "name"); !ok {
 			return 400, "Required argument '" + lack + "' not defined."
 		}
-		err := UpdateUserBalance(commiterUid, apiArgs["name"][0], apiArgs["delta"][0])
+		err := UpdateUserBalance(commiter, apiArgs["name"][0], apiArgs["delta"][0])
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
@@ -145,7 +395,7 @@ func httpApiFuncImpl(w http.ResponseWriter, r *http.Request) (int, string) {
 		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
 			return 400, "Required argument '" + lack + "' not defined."
 		}
-		content, err := QueryUserInfo(commiterUid, apiArgs["name"][0])
+		content, err := QueryUserInfo(commiter, apiArgs["name"][0])
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
@@ -155,41 +405,639 @@ func httpApiFuncImpl(w http.ResponseWriter, r *http.Request) (int, string) {
 		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
 			return 400, "Required argument '" + lack + "' not defined."
 		}
-		content, err := QueryBalanceLog(commiterUid, apiArgs["name"][0])
+		page, err := ParsePage(apiArgs)
+		if err != nil {
+			return 400, err.Error()
+		}
+		content, err := QueryBalanceLog(commiter, apiArgs["name"][0], page)
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
 			return 200, content
 		}
+	case "CreateBalanceBatch":
+		if lack, ok := apiExistArgs(apiArgs, "note"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		// An uploaded list comes as the body, the other arguments in the URL.
+		body, err := readUpload(w, r)
+		if err != nil {
+			return 400, "Unable to read request body. " + err.Error()
+		}
+		selector := BatchSelector{Plan: apiArgs.Get("plan"), Status: apiArgs.Get("status")}
+		if names := apiArgs.Get("names"); names != "" {
+			selector.Names = strings.Split(names, ",")
+		}
+		id, err := CreateBalanceBatch(commiter, selector, string(body), apiArgs.Get("amount"), apiArgs["note"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "id=" + strconv.FormatInt(int64(id), 10)
+		}
+	case "ListBalanceBatches":
+		page, err := ParsePage(apiArgs)
+		if err != nil {
+			return 400, err.Error()
+		}
+		content, err := ListBalanceBatches(commiter, page)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "QueryBalanceBatch":
+		if lack, ok := apiExistArgs(apiArgs, "id"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		id, err := strconv.ParseInt(apiArgs["id"][0], 10, 64)
+		if err != nil {
+			return 400, "Invalid batch id."
+		}
+		page, err := ParsePage(apiArgs)
+		if err != nil {
+			return 400, err.Error()
+		}
+		content, err := QueryBalanceBatch(commiter, tools.BatchidT(id), page)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "ApplyBalanceBatch":
+		if lack, ok := apiExistArgs(apiArgs, "id"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		id, err := strconv.ParseInt(apiArgs["id"][0], 10, 64)
+		if err != nil {
+			return 400, "Invalid batch id."
+		}
+		err = ApplyBalanceBatch(commiter, tools.BatchidT(id))
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "ReverseBalanceBatch":
+		if lack, ok := apiExistArgs(apiArgs, "id"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		id, err := strconv.ParseInt(apiArgs["id"][0], 10, 64)
+		if err != nil {
+			return 400, "Invalid batch id."
+		}
+		err = ReverseBalanceBatch(commiter, tools.BatchidT(id))
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "DiscardBalanceBatch":
+		if lack, ok := apiExistArgs(apiArgs, "id"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		id, err := strconv.ParseInt(apiArgs["id"][0], 10, 64)
+		if err != nil {
+			return 400, "Invalid batch id."
+		}
+		err = DiscardBalanceBatch(commiter, tools.BatchidT(id))
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
 	case "ResetDatabase":
 		if lack, ok := apiExistArgs(apiArgs, "new_root_password"); !ok {
 			return 400, "Required argument '" + lack + "' not defined."
 		}
-		err := ResetDatabase(commiterUid, apiArgs["new_root_password"][0])
+		err := ResetDatabase(commiter, apiArgs["new_root_password"][0])
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
 			_ = tools.DoLogout(token)
+			clearSessionCookies(w, r)
 			return 200, "status=ok"
 		}
 	case "ListAllUserInfo":
-		content, err := ListAllUserInfo(commiterUid)
+		page, err := ParsePage(apiArgs)
+		if err != nil {
+			return 400, err.Error()
+		}
+		filter := UserFilter{Role: apiArgs.Get("role"), Plan: apiArgs.Get("plan"), Status: apiArgs.Get("status"),
+			NamePrefix: apiArgs.Get("name_prefix"), MinBalance: apiArgs.Get("min_balance"), MaxBalance: apiArgs.Get("max_balance")}
+		content, err := ListAllUserInfo(commiter, filter, page)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "QueryProfile":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		content, err := QueryProfile(commiter, apiArgs["name"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "UpdateProfile":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		// Only the fields given change.
+		changes := make(map[string]string)
+		for _, field := range tools.ProfileFields {
+			if values, ok := apiArgs[field]; ok {
+				changes[field] = values[0]
+			}
+		}
+		if values, ok := apiArgs["lang"]; ok {
+			changes["lang"] = values[0]
+		}
+		err := UpdateProfile(commiter, apiArgs["name"][0], changes)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "SearchUsers":
+		if lack, ok := apiExistArgs(apiArgs, "q"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		page, err := ParsePage(apiArgs)
+		if err != nil {
+			return 400, err.Error()
+		}
+		content, err := SearchUsers(commiter, apiArgs["q"][0], page)
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
 			return 200, content
 		}
 	case "ListAllPlanInfo":
-		content, err := ListAllPlanInfo(commiterUid)
+		page, err := ParsePage(apiArgs)
+		if err != nil {
+			return 400, err.Error()
+		}
+		filter := PlanFilter{NamePrefix: apiArgs.Get("name_prefix"), MinPrice: apiArgs.Get("min_price"), MaxPrice: apiArgs.Get("max_price")}
+		content, err := ListAllPlanInfo(commiter, filter, page)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "AddPhoneNumbers":
+		if lack, ok := apiExistArgs(apiArgs, "from", "to"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		count, err := AddPhoneNumbers(commiter, apiArgs["from"][0], apiArgs["to"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "added=" + strconv.Itoa(count)
+		}
+	case "SearchAvailableNumbers":
+		if lack, ok := apiExistArgs(apiArgs, "pattern"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		content, err := SearchAvailableNumbers(commiter, apiArgs["pattern"][0])
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
 			return 200, content
 		}
+	case "ReserveNumber":
+		if lack, ok := apiExistArgs(apiArgs, "number"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := ReserveNumber(commiter, apiArgs["number"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "AssignNumber":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		number, err := AssignNumber(commiter, apiArgs["name"][0], apiArgs.Get("number"))
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "number=" + number
+		}
+	case "ImportSimBatch":
+		body, err := readUpload(w, r)
+		if err != nil {
+			return 400, "Unable to read request body. " + err.Error()
+		}
+		count, err := ImportSimBatch(commiter, string(body))
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "imported=" + strconv.Itoa(count)
+		}
+	case "ImportUsers":
+		body, err := readUpload(w, r)
+		if err != nil {
+			return 400, "Unable to read request body. " + err.Error()
+		}
+		mode := apiArgs.Get("mode")
+		if mode == "" {
+			mode = ImportDryRun
+		}
+		content, err := ImportUsers(commiter, string(body), mode)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "PairSim":
+		if lack, ok := apiExistArgs(apiArgs, "name", "iccid"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := PairSim(commiter, apiArgs["name"][0], apiArgs["iccid"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "SwapSim":
+		if lack, ok := apiExistArgs(apiArgs, "name", "iccid", "reason"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := SwapSim(commiter, apiArgs["name"][0], apiArgs["iccid"][0], apiArgs["reason"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "ReportSimLost":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := ReportSimLost(commiter, apiArgs["name"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "SetCreditLimit":
+		if lack, ok := apiExistArgs(apiArgs, "name", "limit"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := SetCreditLimit(commiter, apiArgs["name"][0], apiArgs["limit"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "SetAccountType":
+		if lack, ok := apiExistArgs(apiArgs, "name", "account_type"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := SetAccountType(commiter, apiArgs["name"][0], apiArgs["account_type"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "QueryInvoices":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		content, err := QueryInvoices(commiter, apiArgs["name"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "QueryInvoiceLines":
+		if lack, ok := apiExistArgs(apiArgs, "id"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		id, err := strconv.ParseInt(apiArgs["id"][0], 10, 64)
+		if err != nil {
+			return 400, "Invalid invoice id."
+		}
+		content, err := QueryInvoiceLines(commiter, tools.InvoiceidT(id))
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "CreatePromotion":
+		if lack, ok := apiExistArgs(apiArgs, "code", "kind"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		p, err := parsePromotionArgs(apiArgs)
+		if err != nil {
+			return 400, err.Error()
+		}
+		id, err := CreatePromotion(commiter, p)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "id=" + strconv.FormatInt(int64(id), 10)
+		}
+	case "ListPromotions":
+		page, err := ParsePage(apiArgs)
+		if err != nil {
+			return 400, err.Error()
+		}
+		content, err := ListPromotions(commiter, page)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "DisablePromotion":
+		if lack, ok := apiExistArgs(apiArgs, "code"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := DisablePromotion(commiter, apiArgs["code"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "RedeemPromotion":
+		if lack, ok := apiExistArgs(apiArgs, "name", "code"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := RedeemPromotion(commiter, apiArgs["name"][0], apiArgs["code"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "ListRedemptions":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		content, err := ListRedemptions(commiter, apiArgs["name"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "QueryDunningStatus":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		content, err := QueryDunningStatus(commiter, apiArgs["name"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "SetNotificationPreference":
+		if lack, ok := apiExistArgs(apiArgs, "name", "type", "enabled"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		enabled, err := strconv.ParseBool(apiArgs["enabled"][0])
+		if err != nil {
+			return 400, "Argument 'enabled' must be true or false."
+		}
+		err = SetNotificationPreference(commiter, apiArgs["name"][0], apiArgs["type"][0], enabled)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "SetLowBalanceThreshold":
+		if lack, ok := apiExistArgs(apiArgs, "name", "threshold"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := SetLowBalanceThreshold(commiter, apiArgs["name"][0], apiArgs["threshold"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "SetLanguage":
+		if lack, ok := apiExistArgs(apiArgs, "name", "lang"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := SetLanguage(commiter, apiArgs["name"][0], apiArgs["lang"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "QueryNotificationSettings":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		content, err := QueryNotificationSettings(commiter, apiArgs["name"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "ListOutboxEmails":
+		if lack, ok := apiExistArgs(apiArgs, "state"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		content, err := ListOutboxEmails(commiter, apiArgs["state"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "RequeueEmail":
+		if lack, ok := apiExistArgs(apiArgs, "id"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := RequeueEmail(commiter, apiArgs["id"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "RunBillingCycle":
+		if lack, ok := apiExistArgs(apiArgs, "period"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := TriggerBillingCycle(commiter, apiArgs["period"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "ListRoles":
+		content, err := ListRoles(commiter)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "CreateRole":
+		if lack, ok := apiExistArgs(apiArgs, "role", "grants"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := CreateRole(commiter, apiArgs["role"][0], apiArgs.Get("description"), apiArgs["grants"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "UpdateRole":
+		if lack, ok := apiExistArgs(apiArgs, "role", "grants"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := UpdateRole(commiter, apiArgs["role"][0], apiArgs.Get("description"), apiArgs["grants"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "DeleteRole":
+		if lack, ok := apiExistArgs(apiArgs, "role"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := DeleteRole(commiter, apiArgs["role"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "SetUserRoles":
+		if lack, ok := apiExistArgs(apiArgs, "name", "roles"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := SetUserRoles(commiter, apiArgs["name"][0], apiArgs["roles"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "BeginTotpEnrollment":
+		content, err := BeginTotpEnrollment(commiter)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "ConfirmTotpEnrollment":
+		if lack, ok := apiExistArgs(apiArgs, "code"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		content, err := ConfirmTotpEnrollment(commiter, apiArgs["code"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "RegenerateRecoveryCodes":
+		if lack, ok := apiExistArgs(apiArgs, "code"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		content, err := RegenerateRecoveryCodes(commiter, apiArgs["code"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "DisableTotp":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := DisableTotp(commiter, apiArgs["name"][0], apiArgs.Get("code"))
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "SetRoleTotpRequirement":
+		if lack, ok := apiExistArgs(apiArgs, "role", "required"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		required, err := strconv.ParseBool(apiArgs["required"][0])
+		if err != nil {
+			return 400, "Argument 'required' must be true or false."
+		}
+		err = SetRoleTotpRequirement(commiter, apiArgs["role"][0], required)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "CreateApiKey":
+		if lack, ok := apiExistArgs(apiArgs, "name", "owner", "permissions"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		content, err := CreateApiKey(commiter, apiArgs["name"][0], apiArgs["owner"][0], apiArgs["permissions"][0],
+			apiArgs.Get("allowed_ips"), apiArgs.Get("expires"))
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "ListApiKeys":
+		content, err := ListApiKeys(commiter)
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "RotateApiKey":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		content, err := RotateApiKey(commiter, apiArgs["name"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "RevokeApiKey":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		err := RevokeApiKey(commiter, apiArgs["name"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, "status=ok"
+		}
+	case "QueryAuditLog":
+		content, err := QueryAuditLog(commiter, apiArgs.Get("actor"), apiArgs.Get("action"), apiArgs.Get("target"),
+			apiArgs.Get("since"), apiArgs.Get("until"))
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			return 200, content
+		}
+	case "ExportAuditLog":
+		content, err := ExportAuditLog(commiter, apiArgs.Get("actor"), apiArgs.Get("action"), apiArgs.Get("target"),
+			apiArgs.Get("since"), apiArgs.Get("until"))
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", "attachment; filename=audit.csv")
+			return 200, content
+		}
+	case "ExportPersonalData":
+		if lack, ok := apiExistArgs(apiArgs, "name"); !ok {
+			return 400, "Required argument '" + lack + "' not defined."
+		}
+		archive, err := ExportPersonalData(commiter, apiArgs["name"][0])
+		if err != nil {
+			return 500, "Server API error: " + err.Error()
+		} else {
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+apiArgs["name"][0]+`-data.zip"`)
+			return 200, string(archive)
+		}
 	case "ForgetPassword":
 		if lack, ok := apiExistArgs(apiArgs, "email", "domain", "proto"); !ok {
 			return 400, "Required argument '" + lack + "' not defined."
 		}
+		if !ForgetPasswordRateLimit.Allow(commiter.Ip) {
+			return 429, "Too many attempts. Try again later."
+		}
 		err := tools.ForgetPassword(apiArgs["email"][0], apiArgs["domain"][0], apiArgs["proto"][0])
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
@@ -200,10 +1048,15 @@ func httpApiFuncImpl(w http.ResponseWriter, r *http.Request) (int, string) {
 		if lack, ok := apiExistArgs(apiArgs, "old", "new", "name"); !ok {
 			return 400, "Required argument '" + lack + "' not defined."
 		}
-		err := tools.ChangePassword(apiArgs["name"][0], apiArgs["old"][0], apiArgs["new"][0])
+		if !LoginRateLimit.Allow(commiter.Ip) {
+			return 429, "Too many attempts. Try again later."
+		}
+		err := tools.ChangePassword(commiter, apiArgs["name"][0], apiArgs["old"][0], apiArgs["new"][0])
 		if err != nil {
 			return 500, "Server API error: " + err.Error()
 		} else {
+			// Every session of the user ended, this browser must log in again.
+			clearSessionCookies(w, r)
 			return 200, "status=ok"
 		}
 
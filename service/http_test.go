@@ -0,0 +1,89 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+)
+
+func TestMutatingMethodsRequirePost(t *testing.T) {
+	w := httptest.NewRecorder()
+	HttpApiFunc(w, httptest.NewRequest("GET", "/UpdateUserBalance?name=bob&delta=100.00", nil))
+	if w.Code != 405 {
+		t.Errorf("GET of a mutating method: got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	HttpApiFunc(w, httptest.NewRequest("GET", "/QueryUserInfo?name=bob", nil))
+	if w.Code != 403 {
+		t.Errorf("GET of a safe method should reach authentication, got %d", w.Code)
+	}
+}
+
+func TestCsrfToken(t *testing.T) {
+	token, err := tools.NewSession(1001, "127.0.0.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tools.RevokeUserSessions(1001)
+
+	r := httptest.NewRequest("POST", "/RemoveUser?name=bob", nil)
+	r.AddCookie(&http.Cookie{Name: "token", Value: token})
+	w := httptest.NewRecorder()
+	HttpApiFunc(w, r)
+	if w.Code != 403 {
+		t.Errorf("cookie without CSRF token: got %d", w.Code)
+	}
+
+	r.Header.Set("X-Csrf-Token", tools.CsrfToken("another session"))
+	w = httptest.NewRecorder()
+	HttpApiFunc(w, r)
+	if w.Code != 403 {
+		t.Errorf("CSRF token of another session: got %d", w.Code)
+	}
+
+	if !tools.CheckCsrfToken(token, tools.CsrfToken(token)) {
+		t.Error("the CSRF token of the session is refused")
+	}
+}
+
+func TestSessionCookies(t *testing.T) {
+	w := httptest.NewRecorder()
+	setSessionCookies(w, httptest.NewRequest("POST", "/Login", nil), "secret")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 2 || cookies[0].Name != "token" || cookies[1].Name != "csrf_token" {
+		t.Fatalf("got %v", cookies)
+	}
+	if !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode || cookies[0].Path != "/" {
+		t.Errorf("session cookie attributes: %v", cookies[0])
+	}
+	if cookies[1].HttpOnly || cookies[1].Value != tools.CsrfToken("secret") {
+		t.Errorf("CSRF cookie must be readable by the pages: %v", cookies[1])
+	}
+}
+
+func TestReadUpload(t *testing.T) {
+	defer func(max int64) { MaxUploadBytes = max }(MaxUploadBytes)
+	MaxUploadBytes = 8
+
+	r := httptest.NewRequest("POST", "/ImportUsers", strings.NewReader("name,email"))
+	r.Header.Set("Content-Type", "text/csv")
+	if _, err := readUpload(httptest.NewRecorder(), r); err == nil {
+		t.Error("accepted a body over the limit")
+	}
+
+	r = httptest.NewRequest("POST", "/ImportUsers", strings.NewReader("a,b"))
+	r.Header.Set("Content-Type", "text/csv")
+	if body, err := readUpload(httptest.NewRecorder(), r); err != nil || string(body) != "a,b" {
+		t.Errorf("got %q, %v", body, err)
+	}
+
+	r = httptest.NewRequest("POST", "/ImportUsers", strings.NewReader("mode=x"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if _, err := readUpload(httptest.NewRecorder(), r); err == nil {
+		t.Error("accepted a form body")
+	}
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+)
+
+// operatorOf is the operator behind an impersonation session, who the audit log records.
+func operatorOf(commiter tools.Actor) tools.Actor {
+	operator := commiter
+	operator.Uid = commiter.Impersonator
+	operator.Impersonator = 0
+	return operator
+}
+
+// StartImpersonation opens a read-only session as a customer, for the operator logged in with
+// parentToken to see what the customer sees. It returns the token of the new session.
+func StartImpersonation(commiter tools.Actor, parentToken, username string) (string, tools.Session, error) {
+	if commiter.Can(tools.PermUserImpersonate) == false {
+		return "", tools.Session{}, errors.New("Permission denied.")
+	}
+	if commiter.Session == "" || commiter.Impersonator != 0 {
+		return "", tools.Session{}, errors.New("Impersonation starts from your own login session.")
+	}
+	u, err := tools.UsernameToInfo(username)
+	if err != nil {
+		return "", tools.Session{}, err
+	}
+	if !tools.CheckPermission(u.Id, tools.PermCustomer) {
+		return "", tools.Session{}, errors.New("Only customers can be impersonated.")
+	}
+	if checkUserUpdatePermission(commiter, u.Roles) == false {
+		return "", tools.Session{}, errors.New("Permission denied.")
+	}
+
+	token, s, err := tools.NewImpersonationSession(parentToken, u, commiter.Ip, commiter.UserAgent)
+	if err != nil {
+		return "", s, err
+	}
+	err = tools.AuditUser(tools.DB_, commiter, "StartImpersonation", u.Id, u.Name, nil,
+		map[string]string{"session": s.Id, "until": s.Until.Format(time.RFC3339)})
+	if err != nil {
+		_, _, _ = tools.EndImpersonation(token)
+		return "", s, err
+	}
+	return token, s, nil
+}
+
+// StopImpersonation ends the impersonation session of the request and returns the token of the
+// operator's own session, empty if it is over.
+func StopImpersonation(commiter tools.Actor, token string) (string, error) {
+	if commiter.Impersonator == 0 {
+		return "", errors.New("This is not an impersonation session.")
+	}
+	s, parent, err := tools.EndImpersonation(token)
+	if err != nil {
+		return "", err
+	}
+	return parent, tools.AuditUser(tools.DB_, operatorOf(commiter), "StopImpersonation", commiter.Uid, s.UserName, nil,
+		map[string]string{"session": s.Id})
+}
+
+// secretArgs are the API arguments carrying credentials, which the audit trail must not keep.
+var secretArgs = map[string]bool{
+	"token": true, "password": true, "old": true, "new": true, "new_root_password": true, "code": true, "challenge": true,
+}
+
+// auditedArgs are the arguments of a call as the audit trail records them, secrets redacted.
+func auditedArgs(apiArgs url.Values) url.Values {
+	args := url.Values{}
+	for k, v := range apiArgs {
+		if secretArgs[k] {
+			args.Set(k, "redacted")
+		} else {
+			args[k] = v
+		}
+	}
+	return args
+}
+
+// auditImpersonatedCall records every call made in an impersonation session, under the operator. Pass
+// the parsed form, so that the arguments of POST calls are recorded too.
+func auditImpersonatedCall(commiter tools.Actor, userName, apiMethod string, apiArgs url.Values) error {
+	return tools.AuditUser(tools.DB_, operatorOf(commiter), "ImpersonatedCall", commiter.Uid, userName, nil,
+		map[string]string{"session": commiter.Session, "method": apiMethod, "args": auditedArgs(apiArgs).Encode()})
+}
@@ -0,0 +1,22 @@
+package service
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestAuditedArgs(t *testing.T) {
+	args := url.Values{"name": {"alice"}, "token": {"t"}, "password": {"p"}, "old": {"o"}, "new": {"n"}, "code": {"123456"}}
+	got := auditedArgs(args)
+	if got.Get("name") != "alice" {
+		t.Errorf("lost an argument: %v", got)
+	}
+	for _, k := range []string{"token", "password", "old", "new", "code"} {
+		if got.Get(k) != "redacted" {
+			t.Errorf("%s not redacted: %v", k, got)
+		}
+	}
+	if args.Get("password") != "p" {
+		t.Error("changed the arguments of the call")
+	}
+}
@@ -0,0 +1,311 @@
+package service
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+)
+
+const maxUsersPerImport = 5000
+
+// Modes of ImportUsers.
+const (
+	ImportDryRun       = "dry_run"        // validate only
+	ImportAllOrNothing = "all_or_nothing" // import every row, or none if any row is invalid or fails
+	ImportBestEffort   = "best_effort"    // import the valid rows, each on its own
+)
+
+var ImportModes = []string{ImportDryRun, ImportAllOrNothing, ImportBestEffort}
+
+// Results of the rows of an import.
+const (
+	importValid    = "valid"
+	importInvalid  = "invalid"
+	importImported = "imported"
+	importFailed   = "failed"
+	importSkipped  = "skipped"
+)
+
+// userImportRow is one line of a user import. Problem tells why the row cannot be imported.
+type userImportRow struct {
+	Line      int
+	Name      string
+	Email     string
+	RoleNames string
+	Plan      string
+	Balance   tools.MoneyT
+	Problem   string
+	Result    string
+
+	roles    []string
+	customer bool
+	planId   tools.PlanidT
+}
+
+// parseUserCsv reads the columns name,email,role,plan,balance. A header line is allowed, several roles
+// are comma-separated in a quoted field, and plan and balance may be empty. The rows are checked on
+// their own and against each other only, see checkUserImport for the rest.
+func parseUserCsv(content string) ([]userImportRow, error) {
+	reader := csv.NewReader(strings.NewReader(content))
+	reader.FieldsPerRecord = 5
+	reader.TrimLeadingSpace = true
+
+	var rows []userImportRow
+	seen := make(map[string]int)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.EqualFold(record[0], "name") {
+			continue
+		}
+
+		row := userImportRow{Line: line, Name: strings.TrimSpace(record[0]), Email: strings.TrimSpace(record[1]),
+			RoleNames: record[2], Plan: strings.TrimSpace(record[3])}
+		balance, balanceErr := tools.StringToMoneyT(strings.TrimSpace(record[4]))
+		row.Balance = balance
+		addr, emailErr := mail.ParseAddress(row.Email)
+		switch {
+		case row.Name == "" || !tools.UsernameRegex.MatchString(row.Name):
+			row.Problem = "Invalid username format."
+		case emailErr != nil || addr.Address != row.Email:
+			row.Problem = "Invalid email: " + row.Email
+		case balanceErr != nil:
+			row.Problem = "Invalid opening balance: " + record[4]
+		case row.Balance < 0:
+			row.Problem = "The opening balance must not be negative."
+		case seen["name:"+row.Name] != 0:
+			row.Problem = fmt.Sprintf("Duplicated name, see line %d.", seen["name:"+row.Name])
+		case seen["email:"+strings.ToLower(row.Email)] != 0:
+			row.Problem = fmt.Sprintf("Duplicated email, see line %d.", seen["email:"+strings.ToLower(row.Email)])
+		}
+		if seen["name:"+row.Name] == 0 {
+			seen["name:"+row.Name] = line
+		}
+		if seen["email:"+strings.ToLower(row.Email)] == 0 {
+			seen["email:"+strings.ToLower(row.Email)] = line
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 {
+		return nil, errors.New("The file contains no user.")
+	}
+	if len(rows) > maxUsersPerImport {
+		return nil, fmt.Errorf("An import must contain at most %d users.", maxUsersPerImport)
+	}
+	return rows, nil
+}
+
+// checkUserImport checks the rows against the database and the permissions of the commiter: the roles
+// and plans must exist, and the names and emails must be free. Customers left without a number by an
+// empty inventory get one later with AssignNumber.
+func checkUserImport(commiter tools.Actor, rows []userImportRow) error {
+	var names, emails []string
+	for _, row := range rows {
+		names = append(names, row.Name)
+		emails = append(emails, strings.ToLower(row.Email))
+	}
+	var existing []tools.UserInfo
+	err := tools.DB_.Model(&existing).Column("name", "email").
+		Where("name IN (?) OR lower(email) IN (?)", pg.In(names), pg.In(emails)).Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return err
+	}
+	taken := make(map[string]bool)
+	for _, u := range existing {
+		taken["name:"+u.Name] = true
+		taken["email:"+strings.ToLower(u.Email)] = true
+	}
+
+	plans := make(map[string]tools.PlanInfo)
+	for i := range rows {
+		row := &rows[i]
+		if row.Problem != "" {
+			continue
+		}
+		if taken["name:"+row.Name] {
+			row.Problem = "Name already taken."
+			continue
+		}
+		if taken["email:"+strings.ToLower(row.Email)] {
+			row.Problem = "Email already registered."
+			continue
+		}
+
+		roles, err := tools.ParseRoles(row.RoleNames)
+		if err != nil {
+			row.Problem = err.Error()
+			continue
+		}
+		if len(roles) == 0 {
+			row.Problem = "No role."
+			continue
+		}
+		if checkUserUpdatePermission(commiter, roles) == false {
+			row.Problem = "Permission denied."
+			continue
+		}
+		grants, err := tools.RoleGrants(tools.DB_, roles)
+		if err != nil {
+			return err
+		}
+		row.roles = roles
+		row.customer = grants.Has(tools.PermCustomer)
+
+		if row.Plan != "" {
+			if !row.customer {
+				row.Problem = "Only customer can have a plan."
+				continue
+			}
+			if commiter.Can(tools.PermPlanAssign) == false {
+				row.Problem = "Permission denied to assign plans."
+				continue
+			}
+			p, ok := plans[row.Plan]
+			if !ok {
+				if p, err = tools.PlannameToInfo(row.Plan); err != nil {
+					row.Problem = "Unknown plan: " + row.Plan
+					continue
+				}
+				plans[row.Plan] = p
+			}
+			row.planId = p.Id
+		}
+		if row.Balance != 0 {
+			if !row.customer {
+				row.Problem = "Only customer can have a balance."
+				continue
+			}
+			if commiter.Grants.Allows(tools.PermBalanceTopup, row.Balance) == false {
+				row.Problem = "The opening balance exceeds your limit of " + commiter.Grants[tools.PermBalanceTopup].String()
+				continue
+			}
+		}
+	}
+	return nil
+}
+
+// importedUser is the user of a checked row. Its password is an unusable secret until the user chooses
+// one through the forgotten password email.
+func importedUser(row userImportRow) (tools.UserInfo, error) {
+	password, err := tools.UnusablePassword()
+	if err != nil {
+		return tools.UserInfo{}, err
+	}
+	return tools.UserInfo{Name: row.Name, Email: row.Email, Roles: row.roles, Plan: row.planId, Password: password}, nil
+}
+
+// importUserRow creates the user of a checked row, with its plan and opening balance.
+func importUserRow(tx *pg.Tx, commiter tools.Actor, row userImportRow) error {
+	u, err := importedUser(row)
+	if err != nil {
+		return err
+	}
+	if err := createUser(tx, commiter, &u, row.customer, ""); err != nil {
+		return err
+	}
+	if row.Balance > 0 {
+		return applyBalanceChange(tx, &u, row.Balance, "opening_balance", fmt.Sprintf("by %d", commiter.Uid))
+	}
+	return nil
+}
+
+// ImportUsers adds the users of a CSV file, see parseUserCsv, and reports the result of every row.
+// Imported users cannot log in until they choose a password through the forgotten password email.
+// Customers get the lowest available numbers, and the commiter earns as for AddUser.
+func ImportUsers(commiter tools.Actor, content, mode string) (string, error) {
+	if commiter.Can(tools.PermUserManageCustomers) == false && commiter.Can(tools.PermUserManageStaff) == false {
+		return "", errors.New("Permission denied.")
+	}
+	if tools.ArrayContains(ImportModes, mode) == false {
+		return "", errors.New("Unknown import mode. Use one of " + strings.Join(ImportModes, ","))
+	}
+
+	rows, err := parseUserCsv(content)
+	if err != nil {
+		return "", err
+	}
+	if err := checkUserImport(commiter, rows); err != nil {
+		return "", err
+	}
+	valid := 0
+	for i := range rows {
+		if rows[i].Problem == "" {
+			rows[i].Result = importValid
+			valid++
+		} else {
+			rows[i].Result = importInvalid
+		}
+	}
+
+	switch {
+	case mode == ImportAllOrNothing && valid == len(rows):
+		err := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+			for i := range rows {
+				if err := importUserRow(tx, commiter, rows[i]); err != nil {
+					return fmt.Errorf("Line %d: %s", rows[i].Line, err.Error())
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		for i := range rows {
+			rows[i].Result = importImported
+		}
+	case mode == ImportAllOrNothing:
+		for i := range rows {
+			if rows[i].Result == importValid {
+				rows[i].Result = importSkipped
+			}
+		}
+	case mode == ImportBestEffort:
+		for i := range rows {
+			if rows[i].Result != importValid {
+				continue
+			}
+			err := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+				return importUserRow(tx, commiter, rows[i])
+			})
+			if err != nil {
+				rows[i].Result, rows[i].Problem = importFailed, err.Error()
+			} else {
+				rows[i].Result = importImported
+			}
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, row := range rows {
+		counts[row.Result]++
+	}
+	if mode != ImportDryRun {
+		err := tools.Audit(tools.DB_, commiter, "ImportUsers", mode, nil, map[string]int{
+			"total": len(rows), "imported": counts[importImported], "invalid": counts[importInvalid], "failed": counts[importFailed],
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	result := fmt.Sprintf("mode=%s&total=%d&valid=%d&imported=%d&invalid=%d&failed=%d\n",
+		mode, len(rows), valid, counts[importImported], counts[importInvalid], counts[importFailed])
+	for _, row := range rows {
+		result += fmt.Sprintf("line=%d&name=%s&result=%s&error=%s\n",
+			row.Line, url.QueryEscape(row.Name), row.Result, url.QueryEscape(row.Problem))
+	}
+	return result, nil
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseUserCsv(t *testing.T) {
+	rows, err := parseUserCsv(strings.Join([]string{
+		"name,email,role,plan,balance",
+		"alice,alice@example.com,customer,basic,12.50",
+		`bob,bob@example.com,"cashier,customer_serv",,`,
+		"carol,not-an-email,customer,,",
+		"dave,dave@example.com,customer,,-1",
+		"alice,alice2@example.com,customer,,",
+		"erin,ALICE@example.com,customer,,",
+		"frank,frank@example.com,customer,,ten",
+		"bad name!,x@example.com,customer,,",
+	}, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 8 {
+		t.Fatalf("got %d rows", len(rows))
+	}
+	if rows[0].Line != 2 || rows[0].Problem != "" || rows[0].Balance != 1250 || rows[0].Plan != "basic" {
+		t.Errorf("row 1: %+v", rows[0])
+	}
+	if rows[1].Problem != "" || rows[1].RoleNames != "cashier,customer_serv" || rows[1].Balance != 0 {
+		t.Errorf("row 2: %+v", rows[1])
+	}
+	for _, row := range rows[2:] {
+		if row.Problem == "" {
+			t.Errorf("line %d accepted: %+v", row.Line, row)
+		}
+	}
+	if !strings.Contains(rows[4].Problem, "line 2") || !strings.Contains(rows[5].Problem, "line 2") {
+		t.Errorf("duplicates: %q, %q", rows[4].Problem, rows[5].Problem)
+	}
+
+	for _, bad := range []string{"", "name,email,role,plan,balance\n", "alice,alice@example.com,customer\n"} {
+		if _, err := parseUserCsv(bad); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestImportedUserPassword(t *testing.T) {
+	a, err := importedUser(userImportRow{Name: "alice", Email: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := importedUser(userImportRow{Name: "bob", Email: "bob@example.com"})
+	// An empty stored password would let anyone log in with an empty one.
+	if a.Password == "" || a.Password == b.Password {
+		t.Errorf("imported passwords %q and %q", a.Password, b.Password)
+	}
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+)
+
+// NotificationChannel delivers a notification to a customer.
+type NotificationChannel interface {
+	Name() string
+	Send(u tools.UserInfo, msg tools.Email) error
+}
+
+// EmailChannel queues notifications for the customer's security email.
+type EmailChannel struct{}
+
+func (EmailChannel) Name() string {
+	return "email"
+}
+
+func (EmailChannel) Send(u tools.UserInfo, msg tools.Email) error {
+	return tools.EnqueueEmail(tools.DB_, msg)
+}
+
+// SmsChannel posts notifications to an SMS gateway as the form fields `to` and `text`.
+type SmsChannel struct {
+	GatewayURL string
+}
+
+var smsClient = &http.Client{Timeout: 10 * time.Second}
+
+func (SmsChannel) Name() string {
+	return "sms"
+}
+
+func (c SmsChannel) Send(u tools.UserInfo, msg tools.Email) error {
+	number, err := assignedNumberOf(u.Id)
+	if err != nil {
+		return err
+	}
+	if number == "" {
+		return errors.New("The customer has no phone number.")
+	}
+
+	resp, err := smsClient.PostForm(c.GatewayURL, url.Values{"to": {number}, "text": {msg.Subject + "\n" + msg.Body}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("SMS gateway returned " + resp.Status)
+	}
+	return nil
+}
+
+var NotificationChannels = []NotificationChannel{EmailChannel{}}
+
+// DefaultLowBalanceThreshold applies to customers who have not set their own.
+var DefaultLowBalanceThreshold = tools.MoneyT(1000)
+
+func notificationSettingsOf(uid tools.UidT) (tools.NotificationSettings, error) {
+	s := tools.NotificationSettings{UId: uid}
+	err := tools.DB_.Select(&s)
+	if err != nil {
+		if err.Error() == tools.PgNotFoundErr {
+			return tools.NotificationSettings{UId: uid, LowBalanceThreshold: DefaultLowBalanceThreshold}, nil
+		}
+		return s, err
+	}
+	return s, nil
+}
+
+// notify renders the email template named after the notification type in the customer's language,
+// and delivers it on every channel unless the customer opted out of that type.
+// Delivery happens in the background and every attempt is recorded.
+func notify(u tools.UserInfo, notificationType string, data map[string]interface{}) {
+	go func() {
+		settings, err := notificationSettingsOf(u.Id)
+		if err != nil {
+			log.Print("Unable to load notification settings of " + u.Name + ", " + err.Error())
+			return
+		}
+		if tools.ArrayContains(settings.OptOut, notificationType) {
+			return
+		}
+
+		data["Name"] = u.Name
+		msg, err := tools.RenderEmail(notificationType, u.Language, u.Email, data)
+		if err != nil {
+			log.Print("Unable to render notification " + notificationType + ", " + err.Error())
+			return
+		}
+
+		for _, channel := range NotificationChannels {
+			n := tools.Notification{
+				UId:     u.Id,
+				Type:    notificationType,
+				Channel: channel.Name(),
+				Subject: msg.Subject,
+				Body:    msg.Body,
+				Time:    time.Now(),
+			}
+			if err := channel.Send(u, msg); err != nil {
+				n.Error = err.Error()
+				log.Print("Unable to notify " + u.Name + " by " + channel.Name() + ", " + err.Error())
+			}
+			if err := tools.DB_.Insert(&n); err != nil {
+				log.Print("Unable to record notification. " + err.Error())
+			}
+		}
+	}()
+}
+
+// notifyBalanceChange tells a customer about a committed balance change: a credited top-up, or the
+// balance dropping below their threshold.
+func notifyBalanceChange(u tools.UserInfo, before tools.MoneyT, kind string) {
+	if tools.CheckPermission(u.Id, tools.PermCustomer) == false {
+		return
+	}
+
+	if kind == "balance_update" && u.Balance > before {
+		notify(u, tools.NotifyPaymentReceived, map[string]interface{}{
+			"Amount":  (u.Balance - before).String(),
+			"Balance": u.Balance.String(),
+		})
+	}
+
+	if u.Balance < before {
+		settings, err := notificationSettingsOf(u.Id)
+		if err != nil {
+			log.Print("Unable to load notification settings of " + u.Name + ", " + err.Error())
+			return
+		}
+		if before >= settings.LowBalanceThreshold && u.Balance < settings.LowBalanceThreshold {
+			notify(u, tools.NotifyLowBalance, map[string]interface{}{
+				"Balance":   u.Balance.String(),
+				"Threshold": settings.LowBalanceThreshold.String(),
+			})
+		}
+	}
+}
+
+func notificationTarget(commiter tools.Actor, customerUsername string) (tools.UserInfo, error) {
+	u, err := tools.UsernameToInfo(customerUsername)
+	if err != nil {
+		return u, err
+	}
+
+	if u.Id != commiter.Uid {
+		if commiter.Can(tools.PermNotificationManage) == false {
+			return u, errors.New("Permission denied.")
+		}
+	}
+	if tools.CheckPermission(u.Id, tools.PermCustomer) == false {
+		return u, errors.New("Only customer can receive notifications.")
+	}
+	return u, nil
+}
+
+func saveNotificationSettings(s tools.NotificationSettings) error {
+	_, err := tools.DB_.Model(&s).
+		OnConflict("(u_id) DO UPDATE").
+		Set("low_balance_threshold = EXCLUDED.low_balance_threshold, opt_out = EXCLUDED.opt_out").
+		Insert()
+	return err
+}
+
+// SetNotificationPreference opts a customer in or out of one notification type.
+func SetNotificationPreference(commiter tools.Actor, customerUsername, notificationType string, enabled bool) error {
+	u, err := notificationTarget(commiter, customerUsername)
+	if err != nil {
+		return err
+	}
+	if tools.ArrayContains(tools.NotificationTypes, notificationType) == false {
+		return errors.New("Unknown notification type. Use one of " + strings.Join(tools.NotificationTypes, ","))
+	}
+
+	settings, err := notificationSettingsOf(u.Id)
+	if err != nil {
+		return err
+	}
+
+	var optOut []string
+	for _, t := range settings.OptOut {
+		if t != notificationType {
+			optOut = append(optOut, t)
+		}
+	}
+	if !enabled {
+		optOut = append(optOut, notificationType)
+	}
+	settings.OptOut = optOut
+
+	return saveNotificationSettings(settings)
+}
+
+func SetLowBalanceThreshold(commiter tools.Actor, customerUsername, thresholdStr string) error {
+	u, err := notificationTarget(commiter, customerUsername)
+	if err != nil {
+		return err
+	}
+
+	threshold, err := tools.StringToMoneyT(thresholdStr)
+	if err != nil {
+		return err
+	}
+
+	settings, err := notificationSettingsOf(u.Id)
+	if err != nil {
+		return err
+	}
+	settings.LowBalanceThreshold = threshold
+
+	return saveNotificationSettings(settings)
+}
+
+// SetLanguage chooses the language of the emails a user receives.
+func SetLanguage(commiter tools.Actor, username, lang string) error {
+	u, err := tools.UsernameToInfo(username)
+	if err != nil {
+		return err
+	}
+
+	if u.Id != commiter.Uid {
+		if commiter.Can(tools.PermNotificationManage) == false {
+			return errors.New("Permission denied.")
+		}
+	}
+	if tools.ArrayContains(tools.SupportedLanguages, lang) == false {
+		return errors.New("Unsupported language. Use one of " + strings.Join(tools.SupportedLanguages, ","))
+	}
+
+	// Only the language: the rest of the row may have changed since it was read.
+	_, err = tools.DB_.Model(&u).Set("language = ?", lang).WherePK().Update()
+	return err
+}
+
+func QueryNotificationSettings(commiter tools.Actor, customerUsername string) (string, error) {
+	u, err := notificationTarget(commiter, customerUsername)
+	if err != nil {
+		return "", err
+	}
+
+	settings, err := notificationSettingsOf(u.Id)
+	if err != nil {
+		return "", err
+	}
+
+	result := "low_balance_threshold=" + settings.LowBalanceThreshold.String()
+	for _, t := range tools.NotificationTypes {
+		result += fmt.Sprintf("&%s=%t", t, !tools.ArrayContains(settings.OptOut, t))
+	}
+	return result, nil
+}
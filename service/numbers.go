@@ -0,0 +1,252 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// How long a released number stays out of the inventory, and how long an operator may hold one.
+var NumberQuarantinePeriod = 90 * 24 * time.Hour
+var NumberReservationPeriod = 30 * time.Minute
+
+const maxNumbersPerRange = 10000
+const maxNumberSearchResults = 100
+
+var numberPatternRegex = regexp.MustCompile(`^[0-9*?]{1,15}$`)
+
+// numberPatternToLike turns a vanity pattern into a LIKE expression.
+// `*` matches any run of digits and `?` matches exactly one digit.
+func numberPatternToLike(pattern string) (string, error) {
+	if !numberPatternRegex.MatchString(pattern) {
+		return "", errors.New("Invalid number pattern. Use digits, '*' and '?'.")
+	}
+	like := strings.NewReplacer("*", "%", "?", "_").Replace(pattern)
+	if !strings.HasPrefix(like, "%") {
+		like = "%" + like
+	}
+	if !strings.HasSuffix(like, "%") {
+		like += "%"
+	}
+	return like, nil
+}
+
+// reclaimNumbers puts expired reservations and quarantined numbers back into stock.
+func reclaimNumbers(db orm.DB) error {
+	now := time.Now()
+	_, err := db.Model(&tools.PhoneNumber{}).
+		Set("state = ?, reserved_by = NULL, reserved_until = NULL", tools.NumberAvailable).
+		Where("state = ? AND reserved_until < ?", tools.NumberReserved, now).
+		Update()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Model(&tools.PhoneNumber{}).
+		Set("state = ?, quarantine_until = NULL", tools.NumberAvailable).
+		Where("state = ? AND quarantine_until < ?", tools.NumberQuarantined, now).
+		Update()
+	return err
+}
+
+// assignNumber gives a number to a customer. If requested is empty, the lowest available number is used,
+// and while the inventory is empty the customer is left without one, returning an empty number;
+// AssignNumber gives it later. A requested number must be available, or reserved by the commiter.
+func assignNumber(tx *pg.Tx, commiter, uid tools.UidT, requested string) (string, error) {
+	if err := reclaimNumbers(tx); err != nil {
+		return "", err
+	}
+
+	n := tools.PhoneNumber{}
+	if requested == "" {
+		err := tx.Model(&n).Where("state = ?", tools.NumberAvailable).
+			Order("number").Limit(1).For("UPDATE SKIP LOCKED").Select()
+		if err != nil {
+			if err.Error() == tools.PgNotFoundErr {
+				return "", nil
+			}
+			return "", err
+		}
+	} else {
+		if !tools.PhoneNumberRegex.MatchString(requested) {
+			return "", errors.New("Invalid phone number format.")
+		}
+		err := tx.Model(&n).Where("number = ?", requested).For("UPDATE").Select()
+		if err != nil {
+			if err.Error() == tools.PgNotFoundErr {
+				return "", errors.New("Number not in inventory: " + requested)
+			}
+			return "", err
+		}
+		if n.State == tools.NumberReserved && n.ReservedBy != commiter {
+			return "", errors.New("Number is reserved by another operator: " + requested)
+		}
+		if n.State != tools.NumberAvailable && n.State != tools.NumberReserved {
+			return "", errors.New("Number is not available: " + requested)
+		}
+	}
+
+	n.State = tools.NumberAssigned
+	n.UId = uid
+	n.ReservedBy = 0
+	n.ReservedUntil = time.Time{}
+	return n.Number, tx.Update(&n)
+}
+
+// releaseNumber sends the numbers of a removed customer to quarantine.
+func releaseNumber(tx *pg.Tx, uid tools.UidT) error {
+	_, err := tx.Model(&tools.PhoneNumber{}).
+		Set("state = ?, u_id = NULL, quarantine_until = ?", tools.NumberQuarantined, time.Now().Add(NumberQuarantinePeriod)).
+		Where("u_id = ? AND state = ?", uid, tools.NumberAssigned).
+		Update()
+	return err
+}
+
+// assignedNumberOf returns the customer's subscriber line, or an empty string.
+func assignedNumberOf(uid tools.UidT) (string, error) {
+	n := tools.PhoneNumber{}
+	err := tools.DB_.Model(&n).Where("u_id = ? AND state = ?", uid, tools.NumberAssigned).First()
+	if err != nil {
+		if err.Error() == tools.PgNotFoundErr {
+			return "", nil
+		}
+		return "", err
+	}
+	return n.Number, nil
+}
+
+func AddPhoneNumbers(commiter tools.Actor, from, to string) (int, error) {
+	if commiter.Can(tools.PermNumberManage) == false {
+		return 0, errors.New("Permission denied.")
+	}
+
+	if !tools.PhoneNumberRegex.MatchString(from) || !tools.PhoneNumberRegex.MatchString(to) || len(from) != len(to) {
+		return 0, errors.New("Invalid number range.")
+	}
+	first, _ := strconv.ParseInt(from, 10, 64)
+	last, _ := strconv.ParseInt(to, 10, 64)
+	if last < first || last-first >= maxNumbersPerRange {
+		return 0, fmt.Errorf("A range must contain 1 to %d numbers.", maxNumbersPerRange)
+	}
+
+	numbers := make([]tools.PhoneNumber, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		numbers = append(numbers, tools.PhoneNumber{
+			Number: fmt.Sprintf("%0*d", len(from), i),
+			State:  tools.NumberAvailable,
+		})
+	}
+
+	added := 0
+	err := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		res, err := tx.Model(&numbers).OnConflict("DO NOTHING").Insert()
+		if err != nil {
+			return err
+		}
+		added = res.RowsAffected()
+		return tools.Audit(tx, commiter, "AddPhoneNumbers", from+"-"+to, nil, map[string]int{"added": added})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+func SearchAvailableNumbers(commiter tools.Actor, pattern string) (string, error) {
+	if commiter.Can(tools.PermNumberAssign) == false {
+		return "", errors.New("Permission denied.")
+	}
+
+	like, err := numberPatternToLike(pattern)
+	if err != nil {
+		return "", err
+	}
+	if err := reclaimNumbers(tools.DB_); err != nil {
+		return "", err
+	}
+
+	var numbers []tools.PhoneNumber
+	err = tools.DB_.Model(&numbers).
+		Where("state = ? AND number LIKE ?", tools.NumberAvailable, like).
+		Order("number").Limit(maxNumberSearchResults).Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+
+	result := ""
+	for _, n := range numbers {
+		result += "number=" + n.Number + "\n"
+	}
+	return result, nil
+}
+
+func ReserveNumber(commiter tools.Actor, number string) error {
+	if commiter.Can(tools.PermNumberAssign) == false {
+		return errors.New("Permission denied.")
+	}
+	if !tools.PhoneNumberRegex.MatchString(number) {
+		return errors.New("Invalid phone number format.")
+	}
+
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if err := reclaimNumbers(tx); err != nil {
+			return err
+		}
+
+		res, err := tx.Model(&tools.PhoneNumber{}).
+			Set("state = ?, reserved_by = ?, reserved_until = ?", tools.NumberReserved, commiter.Uid, time.Now().Add(NumberReservationPeriod)).
+			Where("number = ? AND state = ?", number, tools.NumberAvailable).
+			Update()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return errors.New("Number is not available: " + number)
+		}
+		return tools.Audit(tx, commiter, "ReserveNumber", number,
+			map[string]string{"state": tools.NumberAvailable}, map[string]string{"state": tools.NumberReserved})
+	})
+}
+
+// AssignNumber gives a phone number to a customer who has none, because the inventory was empty when
+// the account was created. If number is empty, the lowest available number is used.
+func AssignNumber(commiter tools.Actor, customerUsername, number string) (string, error) {
+	if commiter.Can(tools.PermNumberAssign) == false {
+		return "", errors.New("Permission denied.")
+	}
+	u, err := tools.UsernameToInfo(customerUsername)
+	if err != nil {
+		return "", err
+	}
+	if tools.CheckPermission(u.Id, tools.PermCustomer) == false {
+		return "", errors.New("Only customer can have a phone number.")
+	}
+
+	err = tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if _, err := lockUser(tx, u.Id); err != nil {
+			return err
+		}
+		count, err := tx.Model(&tools.PhoneNumber{}).Where("u_id = ? AND state = ?", u.Id, tools.NumberAssigned).Count()
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errors.New("The customer already has a phone number.")
+		}
+		if number, err = assignNumber(tx, commiter.Uid, u.Id, number); err != nil {
+			return err
+		}
+		if number == "" {
+			return errors.New("No phone number available in inventory.")
+		}
+		return tools.AuditUser(tx, commiter, "AssignNumber", u.Id, u.Name, nil, map[string]string{"number": number})
+	})
+	return number, err
+}
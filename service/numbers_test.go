@@ -0,0 +1,24 @@
+package service
+
+import "testing"
+
+func TestNumberPatternToLike(t *testing.T) {
+	patterns := map[string]string{
+		"888":      "%888%",
+		"138*8888": "%138%8888%",
+		"*6666":    "%6666%",
+		"1?0*":     "%1_0%",
+	}
+	for pattern, like := range patterns {
+		res, err := numberPatternToLike(pattern)
+		if err != nil || res != like {
+			t.Error("pattern to like boom: " + pattern + " -- " + res)
+		}
+	}
+
+	for _, pattern := range []string{"", "12a", "1%", "1234567890123456"} {
+		if _, err := numberPatternToLike(pattern); err == nil {
+			t.Error("bad pattern accepted: " + pattern)
+		}
+	}
+}
@@ -5,30 +5,35 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Chips-zhang/DBProjectHust/tools"
 	"github.com/go-pg/pg"
 	"github.com/go-pg/pg/orm"
 )
 
-func checkUserUpdatePermission(commiter tools.UidT, updatedUserPerm []string) bool {
+func checkUserUpdatePermission(commiter tools.Actor, updatedUserRoles []string) bool {
+	grants, err := tools.RoleGrants(tools.DB_, updatedUserRoles)
+	if err != nil {
+		return false
+	}
 	updatedUserIsCustomer := true
-	if tools.ArrayContains(updatedUserPerm, tools.PermAdmin) ||
-		tools.ArrayContains(updatedUserPerm, tools.PermCashier) ||
-		tools.ArrayContains(updatedUserPerm, tools.PermCustomerServ) {
-		updatedUserIsCustomer = false
+	for perm := range grants {
+		if perm != tools.PermCustomer {
+			updatedUserIsCustomer = false
+		}
 	}
 
-	if commiter != tools.RootUid {
+	if commiter.Uid != tools.RootUid {
 		// if uid is 1(root), just skip all check. so that system can create uid 1 without permission.
 		if !updatedUserIsCustomer {
-			// Admin can create non-customer user.
-			if tools.CheckPermission(commiter, tools.PermAdmin) == false {
+			// Staff with any other permission are managed by admins.
+			if commiter.Can(tools.PermUserManageStaff) == false {
 				return false
 			}
 		} else {
 			// costomer_serv can create customer user.
-			if tools.CheckPermission(commiter, tools.PermCustomerServ) == false {
+			if commiter.Can(tools.PermUserManageCustomers) == false {
 				return false
 			}
 		}
@@ -36,67 +41,154 @@ func checkUserUpdatePermission(commiter tools.UidT, updatedUserPerm []string) bo
 	return true
 }
 
-func AddUser(commiter tools.UidT, name, password, permissions, email string) (tools.UidT, error) {
+// AddUser creates a user with a comma-separated list of roles.
+func AddUser(commiter tools.Actor, name, password, roleNames, email, number string) (tools.UidT, error) {
 	// password is already salted-hashed in client.
-	// TODO: role maybe a comma-seperated string as permission list.
-	perm := strings.Split(permissions, ",")
-	if checkUserUpdatePermission(commiter, perm) == false {
+	roles, err := tools.ParseRoles(roleNames)
+	if err != nil {
+		return -1, err
+	}
+	if checkUserUpdatePermission(commiter, roles) == false {
 		return -1, errors.New("Permission denied.")
 	}
+	grants, err := tools.RoleGrants(tools.DB_, roles)
+	if err != nil {
+		return -1, err
+	}
 
-	newUid := tools.UidT(0)
+	u := tools.UserInfo{
+		Name:         name,
+		Password:     password,
+		Roles:        roles,
+		Balance:      0,
+		Achievements: 0,
+		Email:        email,
+	}
+	err = tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		return createUser(tx, commiter, &u, grants.Has(tools.PermCustomer), number)
+	})
+	if err != nil {
+		return -1, err
+	}
+	return u.Id, nil
+}
 
-	err := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
-		u := tools.UserInfo{
-			Name:         name,
-			Password:     password,
-			Permissions:  perm,
-			Balance:      0,
-			Achievements: 0,
-			Email:        email,
+// createUser inserts a new user. A customer gets a phone number, requested or the lowest available if
+// the inventory has any left, and the commiter earns EarningPerAdduser.
+func createUser(tx *pg.Tx, commiter tools.Actor, u *tools.UserInfo, customer bool, number string) error {
+	err := tx.Insert(u)
+	if err != nil {
+		return err
+	}
+	if err := tools.AuditUser(tx, commiter, "AddUser", u.Id, u.Name, nil, u.Redacted()); err != nil {
+		return err
+	}
+
+	if customer {
+		// Every customer gets a phone number from the inventory, once there is one.
+		if _, err := assignNumber(tx, commiter.Uid, u.Id, number); err != nil {
+			return err
+		}
+
+		// The CustomerService is introducing new customer. Give him salary!
+		commiter := tools.UserInfo{
+			Id: commiter.Uid,
+		}
+		err2 := tx.Select(&commiter)
+		if err2 != nil {
+			return err2
 		}
 
-		err := tx.Insert(&u)
+		commiter.Achievements += tools.EarningPerAdduser
+		return tx.Update(&commiter)
+	} else {
+		return nil
+	}
+}
+
+// RemoveUser deactivates a user and archives the account: the balance log and invoices stay, and the
+// retention job erases the personal data later. freeName releases the name and email for new users.
+func RemoveUser(commiter tools.Actor, fuckedUsername string, freeName bool) error {
+	fuckedUser, err := tools.UsernameToInfo(fuckedUsername)
+	if err != nil {
+		return err
+	}
+
+	if checkUserUpdatePermission(commiter, fuckedUser.Roles) == false {
+		return errors.New("Permission denied.")
+	}
+
+	defer tools.InvalidateGrants(fuckedUser.Id)
+	err = tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		// Lock the row, so that a concurrent balance change is neither lost nor reverted.
+		fuckedUser, err := lockUser(tx, fuckedUser.Id)
 		if err != nil {
 			return err
 		}
-		newUid = u.Id
-
-		if tools.ArrayContains(perm, tools.PermCustomer) {
-			// The CustomerService is introducing new customer. Give him salary!
-			commiter := tools.UserInfo{
-				Id: commiter,
-			}
-			err2 := tx.Select(&commiter)
-			if err2 != nil {
-				return err2
-			}
+		if fuckedUser.Status == tools.StatusRemoved {
+			return errors.New("Name not found: " + fuckedUsername)
+		}
+		if err := releaseNumber(tx, fuckedUser.Id); err != nil {
+			return err
+		}
+		if err := blockSims(tx, fuckedUser.Id, "subscriber removed"); err != nil {
+			return err
+		}
+		if err := tools.RevokeApiKeysOf(tx, fuckedUser.Id); err != nil {
+			return err
+		}
+		if _, err := tx.Model(&tools.RecoveryCode{}).Where("u_id = ?", fuckedUser.Id).Delete(); err != nil {
+			return err
+		}
 
-			commiter.Achievements += tools.EarningPerAdduser
-			return tx.Update(&commiter)
-		} else {
-			return nil
+		archived := fuckedUser
+		archived.Status = tools.StatusRemoved
+		archived.RemovedAt = time.Now()
+		archived.Plan = 0
+		archived.Password = ""
+		archived.TotpSecret = ""
+		archived.TotpEnabled = false
+		if freeName {
+			archived.Name = tools.ArchivedName(archived.Id)
+			archived.Email = ""
+		}
+		if err := tools.AuditUser(tx, commiter, "RemoveUser", fuckedUser.Id, fuckedUsername, fuckedUser.Redacted(), archived.Redacted()); err != nil {
+			return err
 		}
+		_, err = tx.Model(&archived).
+			Column("status", "removed_at", "plan", "password", "totp_secret", "totp_enabled", "name", "email").
+			WherePK().Update()
+		return err
 	})
-
-	return newUid, err
+	if err != nil {
+		return err
+	}
+	tools.RevokeUserSessions(fuckedUser.Id)
+	return nil
 }
 
-func RemoveUser(commiter tools.UidT, fuckedUsername string) error {
-	fuckedUser, err := tools.UsernameToInfo(fuckedUsername)
+// UnlockUser lifts the lockout of a user who entered too many wrong passwords.
+func UnlockUser(commiter tools.Actor, username string) error {
+	u, err := tools.UsernameToInfo(username)
 	if err != nil {
 		return err
 	}
 
-	if checkUserUpdatePermission(commiter, fuckedUser.Permissions) == false {
+	if checkUserUpdatePermission(commiter, u.Roles) == false {
 		return errors.New("Permission denied.")
 	}
 
-	return tools.DB_.Delete(&tools.UserInfo{Id: fuckedUser.Id})
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tools.UnlockAccount(tx, u.Id); err != nil {
+			return err
+		}
+		return tools.AuditUser(tx, commiter, "UnlockUser", u.Id, u.Name,
+			map[string]interface{}{"failed_logins": u.FailedLogins, "locked_until": u.LockedUntil}, nil)
+	})
 }
 
-func AddPlan(commiter tools.UidT, planName string, planPriceStr string) (tools.PlanidT, error) {
-	if tools.CheckPermission(commiter, tools.PermCustomerServ) == false {
+func AddPlan(commiter tools.Actor, planName string, planPriceStr string) (tools.PlanidT, error) {
+	if commiter.Can(tools.PermPlanManage) == false {
 		return -1, errors.New("Permission denied")
 	}
 
@@ -110,7 +202,12 @@ func AddPlan(commiter tools.UidT, planName string, planPriceStr string) (tools.P
 		Price: planPrice,
 	}
 
-	err := tools.DB_.Insert(&p)
+	err := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tx.Insert(&p); err != nil {
+			return err
+		}
+		return tools.Audit(tx, commiter, "AddPlan", planName, nil, p)
+	})
 	if err != nil {
 		return -1, err
 	}
@@ -118,13 +215,13 @@ func AddPlan(commiter tools.UidT, planName string, planPriceStr string) (tools.P
 	return p.Id, nil
 }
 
-func RemovePlan(commiter tools.UidT, fuckedPlanname string) error {
+func RemovePlan(commiter tools.Actor, fuckedPlanname string) error {
 	fucked, err := tools.PlannameToInfo(fuckedPlanname)
 	if err != nil {
 		return err
 	}
 
-	if tools.CheckPermission(commiter, tools.PermCustomerServ) == false {
+	if commiter.Can(tools.PermPlanManage) == false {
 		return errors.New("Permission denied.")
 	}
 
@@ -138,11 +235,16 @@ func RemovePlan(commiter tools.UidT, fuckedPlanname string) error {
 		return errors.New("The plan is still in use by some user: " + userUsingThisPlan[0].Name)
 	}
 
-	return tools.DB_.Delete(&tools.PlanInfo{Id: fucked.Id})
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tools.Audit(tx, commiter, "RemovePlan", fuckedPlanname, fucked, nil); err != nil {
+			return err
+		}
+		return tx.Delete(&tools.PlanInfo{Id: fucked.Id})
+	})
 }
 
-func UpdateUserPlan(commiter tools.UidT, fuckedUsername string, planName string) error {
-	if tools.CheckPermission(commiter, tools.PermCustomerServ) == false {
+func UpdateUserPlan(commiter tools.Actor, fuckedUsername string, planName string) error {
+	if commiter.Can(tools.PermPlanAssign) == false {
 		return errors.New("Permission denied.")
 	}
 
@@ -160,13 +262,31 @@ func UpdateUserPlan(commiter tools.UidT, fuckedUsername string, planName string)
 		return err2
 	}
 
+	oldPlan := tools.PlanInfo{Id: u.Plan}
+	if u.Plan != 0 {
+		if err := tools.DB_.Select(&oldPlan); err != nil {
+			return err
+		}
+	}
 	u.Plan = newPlan.Id
 
-	return tools.DB_.Update(&u)
+	err3 := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tx.Update(&u); err != nil {
+			return err
+		}
+		return tools.AuditUser(tx, commiter, "UpdateUserPlan", u.Id, u.Name, oldPlan, newPlan)
+	})
+	if err3 == nil {
+		notify(u, tools.NotifyPlanChanged, map[string]interface{}{
+			"PlanName":  newPlan.Name,
+			"PlanPrice": newPlan.Price.String(),
+		})
+	}
+	return err3
 }
 
-func UpdateUserBalance(commiter tools.UidT, customerUsername string, balanceChangeStr string) error {
-	if tools.CheckPermission(commiter, tools.PermCashier) == false {
+func UpdateUserBalance(commiter tools.Actor, customerUsername string, balanceChangeStr string) error {
+	if commiter.Can(tools.PermBalanceTopup) == false {
 		return errors.New("Permission denied.")
 	}
 
@@ -174,6 +294,9 @@ func UpdateUserBalance(commiter tools.UidT, customerUsername string, balanceChan
 	if err0 != nil {
 		return err0
 	}
+	if commiter.Grants.Allows(tools.PermBalanceTopup, balanceChange) == false {
+		return errors.New("The change exceeds your limit of " + commiter.Grants[tools.PermBalanceTopup].String())
+	}
 
 	u, err := tools.UsernameToInfo(customerUsername)
 	if err != nil {
@@ -184,54 +307,55 @@ func UpdateUserBalance(commiter tools.UidT, customerUsername string, balanceChan
 		return errors.New("Only customer can be updated balance.")
 	}
 
-	// Pull commiter and customer info.
-
-	cashier := tools.UserInfo{
-		Id: commiter,
-	}
-	err1 := tools.DB_.Select(&cashier)
-	if err1 != nil {
-		return err1
-	}
-
-	// Prepare event
-	event := tools.UserBalanceEvent{
-		UId: u.Id,
-		What: fmt.Sprintf("balance_update %s from %s to %s by %d",
-			balanceChange.String(), u.Balance.String(), (u.Balance + balanceChange).String(), commiter),
-	}
-
-	u.Balance += balanceChange
-	if balanceChange > 0 {
-		// cashier receive money and charge user.
-		cashier.Achievements += balanceChange
-	}
-
+	before := tools.MoneyT(0)
 	err2 := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
-		err := tx.Update(&u)
+		var err error
+		u, err = lockUser(tx, u.Id)
 		if err != nil {
 			return err
 		}
+		before = u.Balance
 
-		err2 := tx.Update(&cashier)
-		if err2 != nil {
+		if balanceChange < 0 && u.AccountType == tools.AccountPostpaid && u.Balance+balanceChange < u.BalanceFloor() {
+			return errors.New("Credit limit exceeded. Available: " + (u.Balance - u.BalanceFloor()).String())
+		}
+
+		err = applyBalanceChange(tx, &u, balanceChange, "balance_update", fmt.Sprintf("by %d", commiter.Uid))
+		if err != nil {
+			return err
+		}
+		err = tools.AuditUser(tx, commiter, "UpdateUserBalance", u.Id, u.Name,
+			map[string]string{"balance": before.String()}, map[string]string{"balance": u.Balance.String()})
+		if err != nil {
 			return err
 		}
 
-		return tx.Insert(&event)
+		if balanceChange > 0 {
+			// cashier receive money and charge user.
+			cashier, err := lockUser(tx, commiter.Uid)
+			if err != nil {
+				return err
+			}
+			cashier.Achievements += balanceChange
+			return tx.Update(&cashier)
+		}
+		return nil
 	})
 
+	if err2 == nil {
+		notifyBalanceChange(u, before, "balance_update")
+	}
 	return err2
 }
 
-func QueryUserInfo(commiter tools.UidT, usernameToQuery string) (string, error) {
+func QueryUserInfo(commiter tools.Actor, usernameToQuery string) (string, error) {
 	u, err := tools.UsernameToInfo(usernameToQuery)
 	if err != nil {
 		return "", err
 	}
 
-	if u.Id != commiter {
-		if tools.CheckPermission(commiter, tools.PermCustomerServ) == false {
+	if u.Id != commiter.Uid {
+		if commiter.Can(tools.PermUserView) == false {
 			return "", errors.New("Permission denied.")
 		}
 	}
@@ -242,31 +366,52 @@ func QueryUserInfo(commiter tools.UidT, usernameToQuery string) (string, error)
 		return "", err2
 	}
 
-	return fmt.Sprintf("name=%s&permission=%s&balance=%s&achi=%s&plan_name=%s&plan_price=%s",
-		u.Name, strings.Join(u.Permissions, ","), u.Balance.String(), u.Achievements.String(),
-		p.Name, p.Price.String()), nil
+	number, err3 := assignedNumberOf(u.Id)
+	if err3 != nil {
+		return "", err3
+	}
+	sim, err4 := activeSimOf(u.Id)
+	if err4 != nil {
+		return "", err4
+	}
+	grants, err5 := tools.UserGrants(u.Id)
+	if err5 != nil {
+		return "", err5
+	}
+
+	return formatUserInfo(u, grants, p, number, sim), nil
+}
+
+func formatUserInfo(u tools.UserInfo, grants tools.Grants, p tools.PlanInfo, number, sim string) string {
+	return fmt.Sprintf("name=%s&permission=%s&balance=%s&achi=%s&plan_name=%s&plan_price=%s&number=%s&sim=%s"+
+		"&account_type=%s&credit_limit=%s&status=%s&lang=%s&roles=%s&locked=%t&totp=%t",
+		u.Name, strings.Join(grants.Names(), ","), u.Balance.String(), u.Achievements.String(),
+		p.Name, p.Price.String(), number, sim, u.AccountType, u.CreditLimit.String(), u.Status, u.Language,
+		strings.Join(u.Roles, ","), time.Now().Before(u.LockedUntil), u.TotpEnabled)
 }
 
-func QueryBalanceLog(commiter tools.UidT, usernameToQuery string) (string, error) {
+// QueryBalanceLog lists one page of the balance events of a user, oldest first unless page.Desc.
+func QueryBalanceLog(commiter tools.Actor, usernameToQuery string, page Page) (string, error) {
 	u, err := tools.UsernameToInfo(usernameToQuery)
 	if err != nil {
 		return "", err
 	}
 
-	if u.Id != commiter {
-		if tools.CheckPermission(commiter, tools.PermCustomerServ) == false {
+	if u.Id != commiter.Uid {
+		if commiter.Can(tools.PermBalanceView) == false {
 			return "", errors.New("Permission denied.")
 		}
 	}
 
 	var events []tools.UserBalanceEvent
-	err2 := tools.DB_.Model(&events).Where(fmt.Sprintf("u_id = %d", u.Id)).Select()
-	if err2 != nil {
-		if err2.Error() == tools.PgNotFoundErr {
-			return "events=", nil
-		} else {
-			return "", err2
-		}
+	q, err := page.apply(tools.DB_.Model(&events).Where("u_id = ?", u.Id),
+		map[string]string{"id": "event_id"}, "id", "event_id")
+	if err != nil {
+		return "", err
+	}
+	total, err2 := q.SelectAndCount()
+	if err2 != nil && err2.Error() != tools.PgNotFoundErr {
+		return "", err2
 	}
 
 	eventStrs := make([]string, len(events))
@@ -274,16 +419,21 @@ func QueryBalanceLog(commiter tools.UidT, usernameToQuery string) (string, error
 		eventStrs[index] = event.What
 	}
 
-	return "events=" + strings.Join(eventStrs, "\n"), nil
+	return page.header(total) + "events=" + strings.Join(eventStrs, "\n"), nil
 }
 
-func ResetDatabase(commiter tools.UidT, newRootPassword string) error {
-	if tools.CheckPermission(commiter, tools.PermAdmin) == false {
+func ResetDatabase(commiter tools.Actor, newRootPassword string) error {
+	if commiter.Can(tools.PermDatabaseReset) == false {
 		return errors.New("Permission denied.")
 	}
 
+	defer tools.InvalidateAllGrants()
 	err := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
-		for _, model := range []interface{}{&tools.UserInfo{}, &tools.UserBalanceEvent{}, &tools.PlanInfo{}} {
+		for _, model := range tools.TableModels() {
+			if _, ok := model.(*tools.AuditEntry); ok {
+				// The audit log outlives resets.
+				continue
+			}
 			err := tx.DropTable(model, &orm.DropTableOptions{
 				IfExists: true,
 				Cascade:  true,
@@ -293,7 +443,7 @@ func ResetDatabase(commiter tools.UidT, newRootPassword string) error {
 			}
 		}
 
-		for _, model := range []interface{}{&tools.UserInfo{}, &tools.UserBalanceEvent{}, &tools.PlanInfo{}} {
+		for _, model := range tools.TableModels() {
 			err := tx.CreateTable(model, &orm.CreateTableOptions{
 				IfNotExists: true,
 			})
@@ -301,11 +451,18 @@ func ResetDatabase(commiter tools.UidT, newRootPassword string) error {
 				return err
 			}
 		}
+		// The migrations also create the indexes of the tables.
+		if err := tools.Migrate(tx); err != nil {
+			return err
+		}
+		if err := tools.SeedBuiltinRoles(tx); err != nil {
+			return err
+		}
 
 		u := tools.UserInfo{
-			Name:        "root",
-			Permissions: tools.RolesPermission[tools.RoleAdmin],
-			Password:    newRootPassword,
+			Name:     "root",
+			Roles:    []string{tools.RoleAdmin},
+			Password: newRootPassword,
 		}
 		err3 := tx.Insert(&u)
 		if err3 != nil {
@@ -314,52 +471,172 @@ func ResetDatabase(commiter tools.UidT, newRootPassword string) error {
 		if u.Id != tools.RootUid {
 			return errors.New("ROOT UID is incorrect. Failed to clear db.")
 		}
-		return nil
+		return tools.Audit(tx, commiter, "ResetDatabase", "", nil, nil)
 	})
 
 	return err
 }
 
-func ListAllUserInfo(commiter tools.UidT) (string, error) {
-	if tools.CheckPermission(commiter, tools.PermCustomerServ) == false {
+// UserFilter selects users in ListAllUserInfo. Empty fields do not filter.
+type UserFilter struct {
+	Role       string
+	Plan       string // plan name
+	Status     string // removed users are listed only when filtering by StatusRemoved
+	NamePrefix string
+	MinBalance string
+	MaxBalance string
+}
+
+var userSortColumns = map[string]string{
+	"id": "id", "name": "name", "balance": "balance", "achi": "achievements", "status": "status",
+}
+
+// ListAllUserInfo lists one page of the users matching the filter, by name unless sorted otherwise.
+func ListAllUserInfo(commiter tools.Actor, filter UserFilter, page Page) (string, error) {
+	if commiter.Can(tools.PermUserView) == false {
 		return "", errors.New("Permission denied.")
 	}
 
 	var users []tools.UserInfo
-	err := tools.DB_.Model(&users).Select()
+	q := tools.DB_.Model(&users)
+	if filter.Role != "" {
+		q = q.Where("? = ANY(roles)", filter.Role)
+	}
+	if filter.Plan != "" {
+		q = q.Where("plan IN (SELECT id FROM plan_infos WHERE name = ?)", filter.Plan)
+	}
+	if filter.Status != "" {
+		q = q.Where("status = ?", filter.Status)
+	} else {
+		// Removed users are listed only when asked for.
+		q = q.Where("status <> ?", tools.StatusRemoved)
+	}
+	if filter.NamePrefix != "" {
+		q = q.Where(`name LIKE ? ESCAPE '\'`, likePrefix(filter.NamePrefix))
+	}
+	if min, ok, err := parseMoneyFilter("min_balance", filter.MinBalance); err != nil {
+		return "", err
+	} else if ok {
+		q = q.Where("balance >= ?", min)
+	}
+	if max, ok, err := parseMoneyFilter("max_balance", filter.MaxBalance); err != nil {
+		return "", err
+	} else if ok {
+		q = q.Where("balance <= ?", max)
+	}
+	q, err := page.apply(q, userSortColumns, "name", "id")
 	if err != nil {
 		return "", err
 	}
+	total, err := q.SelectAndCount()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+	if len(users) == 0 {
+		return page.header(total), nil
+	}
+
+	// Look up the numbers, SIMs and plans of this page only.
+	uids := make([]tools.UidT, len(users))
+	planIds := make([]tools.PlanidT, len(users))
+	for i, u := range users {
+		uids[i] = u.Id
+		planIds[i] = u.Plan
+	}
+
+	var numbers []tools.PhoneNumber
+	err = tools.DB_.Model(&numbers).Where("state = ? AND u_id IN (?)", tools.NumberAssigned, pg.In(uids)).Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+	numberOf := make(map[tools.UidT]string)
+	for _, n := range numbers {
+		numberOf[n.UId] = n.Number
+	}
 
-	result := ""
+	var sims []tools.SimCard
+	err = tools.DB_.Model(&sims).Where("state IN (?, ?) AND u_id IN (?)", tools.SimActivated, tools.SimLost, pg.In(uids)).Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+	simOf := make(map[tools.UidT]string)
+	for _, sim := range sims {
+		simOf[sim.UId] = sim.Iccid
+	}
+
+	var plans []tools.PlanInfo
+	err = tools.DB_.Model(&plans).Where("id IN (?)", pg.In(planIds)).Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+	planOf := make(map[tools.PlanidT]tools.PlanInfo)
+	for _, p := range plans {
+		planOf[p.Id] = p
+	}
+
+	var allGrants []tools.RoleGrant
+	err = tools.DB_.Model(&allGrants).Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+	grantsOf := make(map[string][]tools.RoleGrant)
+	for _, g := range allGrants {
+		grantsOf[g.Role] = append(grantsOf[g.Role], g)
+	}
+
+	result := page.header(total)
 
 	for _, u := range users {
-		p := tools.PlanInfo{Id: u.Plan}
-		err2 := tools.DB_.Select(&p)
-		if u.Plan != 0 && err2 != nil {
-			return "", err2
+		var rows []tools.RoleGrant
+		for _, role := range u.Roles {
+			rows = append(rows, grantsOf[role]...)
 		}
-
-		result += fmt.Sprintf("name=%s&permission=%s&balance=%s&achi=%s&plan_name=%s&plan_price=%s",
-			u.Name, strings.Join(u.Permissions, ","), u.Balance.String(), u.Achievements.String(),
-			p.Name, p.Price.String())
+		result += formatUserInfo(u, tools.MergeGrants(rows), planOf[u.Plan], numberOf[u.Id], simOf[u.Id])
 		result += "\n"
 	}
 	return result, nil
 }
 
-func ListAllPlanInfo(commiter tools.UidT) (string, error) {
-	if tools.CheckPermission(commiter, tools.PermCustomerServ) == false {
+// PlanFilter selects plans in ListAllPlanInfo. Empty fields do not filter.
+type PlanFilter struct {
+	NamePrefix string
+	MinPrice   string
+	MaxPrice   string
+}
+
+var planSortColumns = map[string]string{"id": "id", "name": "name", "price": "price"}
+
+// ListAllPlanInfo lists one page of the plans matching the filter, by name unless sorted otherwise.
+func ListAllPlanInfo(commiter tools.Actor, filter PlanFilter, page Page) (string, error) {
+	if commiter.Can(tools.PermPlanView) == false {
 		return "", errors.New("Permission denied.")
 	}
 
 	var plans []tools.PlanInfo
-	err := tools.DB_.Model(&plans).Select()
+	q := tools.DB_.Model(&plans)
+	if filter.NamePrefix != "" {
+		q = q.Where(`name LIKE ? ESCAPE '\'`, likePrefix(filter.NamePrefix))
+	}
+	if min, ok, err := parseMoneyFilter("min_price", filter.MinPrice); err != nil {
+		return "", err
+	} else if ok {
+		q = q.Where("price >= ?", min)
+	}
+	if max, ok, err := parseMoneyFilter("max_price", filter.MaxPrice); err != nil {
+		return "", err
+	} else if ok {
+		q = q.Where("price <= ?", max)
+	}
+	q, err := page.apply(q, planSortColumns, "name", "id")
 	if err != nil {
 		return "", err
 	}
+	total, err := q.SelectAndCount()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
 
-	result := ""
+	result := page.header(total)
 
 	for _, p := range plans {
 		result += fmt.Sprintf("plan_name=%s&plan_price=%s",
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+)
+
+func ListOutboxEmails(commiter tools.Actor, state string) (string, error) {
+	if commiter.Can(tools.PermOutboxManage) == false {
+		return "", errors.New("Permission denied.")
+	}
+	if state != tools.OutboxPending && state != tools.OutboxSent && state != tools.OutboxFailed {
+		return "", errors.New("State must be pending, sent or failed.")
+	}
+
+	var emails []tools.OutboxEmail
+	err := tools.DB_.Model(&emails).Where("state = ?", state).Order("id DESC").Limit(500).Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+
+	result := ""
+	for _, e := range emails {
+		result += fmt.Sprintf("id=%d&to=%s&subject=%s&attempts=%d&created=%s&error=%s\n",
+			e.Id, e.To, e.Subject, e.Attempts, e.CreatedAt.Format(time.RFC3339), e.LastError)
+	}
+	return result, nil
+}
+
+// RequeueEmail gives a failed email a fresh set of delivery attempts. Secret emails are not kept, they
+// must be requested again.
+func RequeueEmail(commiter tools.Actor, idStr string) error {
+	if commiter.Can(tools.PermOutboxManage) == false {
+		return errors.New("Permission denied.")
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return errors.New("Invalid email id.")
+	}
+
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		res, err := tx.Model(&tools.OutboxEmail{}).
+			Set("state = ?, attempts = 0, next_attempt_at = ?", tools.OutboxPending, time.Now()).
+			Where("id = ? AND state = ? AND NOT secret", id, tools.OutboxFailed).
+			Update()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return errors.New("No failed email with this id, or it held a password and must be requested again.")
+		}
+		return tools.Audit(tx, commiter, "RequeueEmail", idStr,
+			map[string]string{"state": tools.OutboxFailed}, map[string]string{"state": tools.OutboxPending})
+	})
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// List APIs return one page of rows at a time, after a first line `total=&offset=&limit=` where total
+// counts every row matching the filters.
+const DefaultPageSize = 100
+const MaxPageSize = 1000
+
+// Page selects the rows of a list API. Sort is one of the sort keys of the list, empty for its default.
+type Page struct {
+	Offset int
+	Limit  int
+	Sort   string
+	Desc   bool
+}
+
+// ParsePage reads the offset, limit, sort and order arguments of a list API.
+func ParsePage(args url.Values) (Page, error) {
+	p := Page{Limit: DefaultPageSize, Sort: args.Get("sort")}
+	var err error
+	if s := args.Get("offset"); s != "" {
+		if p.Offset, err = strconv.Atoi(s); err != nil || p.Offset < 0 {
+			return p, errors.New("Invalid offset: " + s)
+		}
+	}
+	if s := args.Get("limit"); s != "" {
+		if p.Limit, err = strconv.Atoi(s); err != nil || p.Limit <= 0 || p.Limit > MaxPageSize {
+			return p, fmt.Errorf("Invalid limit, use 1 to %d: %s", MaxPageSize, s)
+		}
+	}
+	switch args.Get("order") {
+	case "", "asc":
+	case "desc":
+		p.Desc = true
+	default:
+		return p, errors.New("Invalid order, use asc or desc: " + args.Get("order"))
+	}
+	return p, nil
+}
+
+// apply sorts and limits a query. sortColumns maps the sort keys of the list to columns; ties are
+// broken by the last column, which must be unique so that pages do not overlap.
+func (p Page) apply(q *orm.Query, sortColumns map[string]string, defaultSort, tieColumn string) (*orm.Query, error) {
+	sort := p.Sort
+	if sort == "" {
+		sort = defaultSort
+	}
+	column, ok := sortColumns[sort]
+	if !ok {
+		return q, errors.New("Cannot sort by " + sort)
+	}
+	direction := "ASC"
+	if p.Desc {
+		direction = "DESC"
+	}
+	q = q.OrderExpr("? "+direction, pg.F(column))
+	if column != tieColumn {
+		q = q.OrderExpr("? "+direction, pg.F(tieColumn))
+	}
+	return q.Offset(p.Offset).Limit(p.Limit), nil
+}
+
+func (p Page) header(total int) string {
+	return fmt.Sprintf("total=%d&offset=%d&limit=%d\n", total, p.Offset, p.Limit)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// likePrefix is a LIKE pattern matching the strings starting with s.
+func likePrefix(s string) string {
+	return likeEscaper.Replace(s) + "%"
+}
+
+// likeContains is a LIKE pattern matching the strings containing s.
+func likeContains(s string) string {
+	return "%" + likeEscaper.Replace(s) + "%"
+}
+
+// parseMoneyFilter reads an optional amount bound of a filter.
+func parseMoneyFilter(name, s string) (tools.MoneyT, bool, error) {
+	if s == "" {
+		return 0, false, nil
+	}
+	m, err := tools.StringToMoneyT(s)
+	if err != nil {
+		return 0, false, errors.New("Invalid " + name + ": " + s)
+	}
+	return m, true, nil
+}
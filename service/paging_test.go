@@ -0,0 +1,41 @@
+package service
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParsePage(t *testing.T) {
+	p, err := ParsePage(url.Values{})
+	if err != nil || p.Offset != 0 || p.Limit != DefaultPageSize || p.Sort != "" || p.Desc {
+		t.Errorf("defaults: got %+v, %v", p, err)
+	}
+
+	p, err = ParsePage(url.Values{"offset": {"200"}, "limit": {"50"}, "sort": {"balance"}, "order": {"desc"}})
+	if err != nil || p.Offset != 200 || p.Limit != 50 || p.Sort != "balance" || !p.Desc {
+		t.Errorf("got %+v, %v", p, err)
+	}
+
+	for _, bad := range []url.Values{
+		{"offset": {"-1"}}, {"offset": {"x"}}, {"limit": {"0"}}, {"limit": {"100000"}}, {"order": {"up"}},
+	} {
+		if _, err := ParsePage(bad); err == nil {
+			t.Errorf("accepted %v", bad)
+		}
+	}
+}
+
+func TestLikePrefix(t *testing.T) {
+	cases := map[string]string{"bob": "bob%", "50%_off": `50\%\_off%`, `a\b`: `a\\b%`}
+	for in, want := range cases {
+		if got := likePrefix(in); got != want {
+			t.Errorf("likePrefix(%q): got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestLikeContains(t *testing.T) {
+	if got := likeContains("a_b"); got != `%a\_b%` {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+)
+
+// limitedProfileFields are what cashiers and other staff without PermProfileView see, the ID number masked.
+var limitedProfileFields = []string{"legal_name", "id_type", "id_number"}
+
+// profileVisibility tells how much of a user's profile the commiter sees: "full", "limited" or nothing.
+func profileVisibility(commiter tools.Actor, uid tools.UidT) string {
+	if uid == commiter.Uid || commiter.Can(tools.PermProfileView) {
+		return "full"
+	}
+	if commiter.Can(tools.PermUserView) || commiter.Can(tools.PermBalanceTopup) {
+		return "limited"
+	}
+	return ""
+}
+
+// profileChanges names the fields an update changed. Only the names are audited: audit entries outlive
+// the retention period, and the values are personal data.
+func profileChanges(before, after tools.CustomerProfile, langBefore, langAfter string) []string {
+	changed := []string{}
+	for _, field := range tools.ProfileFields {
+		if before.Get(field) != after.Get(field) {
+			changed = append(changed, field)
+		}
+	}
+	if langBefore != langAfter {
+		changed = append(changed, "lang")
+	}
+	return changed
+}
+
+// QueryProfile returns the profile of a user, as much of it as the commiter may see. Values are URL-encoded.
+func QueryProfile(commiter tools.Actor, username string) (string, error) {
+	u, err := tools.UsernameToInfo(username)
+	if err != nil {
+		return "", err
+	}
+	visibility := profileVisibility(commiter, u.Id)
+	if visibility == "" {
+		return "", errors.New("Permission denied.")
+	}
+	p, err := tools.ProfileOf(u.Id)
+	if err != nil {
+		return "", err
+	}
+
+	result := "name=" + u.Name + "&visibility=" + visibility
+	if visibility == "full" {
+		for _, field := range tools.ProfileFields {
+			result += "&" + field + "=" + url.QueryEscape(p.Get(field))
+		}
+		result += "&lang=" + u.Language
+	} else {
+		for _, field := range limitedProfileFields {
+			value := p.Get(field)
+			if field == "id_number" {
+				value = p.MaskedIdNumber()
+			}
+			result += "&" + field + "=" + url.QueryEscape(value)
+		}
+	}
+	return result, nil
+}
+
+// UpdateProfile changes the given fields of a profile, named as in tools.ProfileFields, and the
+// preferred language "lang". Customers edit their own profile, but once an identity field is set only
+// staff holding PermProfileManage may change it.
+func UpdateProfile(commiter tools.Actor, username string, changes map[string]string) error {
+	u, err := tools.UsernameToInfo(username)
+	if err != nil {
+		return err
+	}
+	self := u.Id == commiter.Uid
+	if !self && (commiter.Can(tools.PermProfileManage) == false || checkUserUpdatePermission(commiter, u.Roles) == false) {
+		return errors.New("Permission denied.")
+	}
+	if len(changes) == 0 {
+		return errors.New("Nothing to change.")
+	}
+	if lang, ok := changes["lang"]; ok && tools.ArrayContains(tools.SupportedLanguages, lang) == false {
+		return errors.New("Unsupported language. Use one of " + strings.Join(tools.SupportedLanguages, ","))
+	}
+
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		p := tools.CustomerProfile{UId: u.Id}
+		err := tx.Model(&p).WherePK().For("UPDATE").Select()
+		if err != nil && err.Error() != tools.PgNotFoundErr {
+			return err
+		}
+		before := p
+
+		for _, field := range tools.ProfileFields {
+			value, ok := changes[field]
+			if !ok {
+				continue
+			}
+			old := p.Get(field)
+			if err := p.Set(field, value); err != nil {
+				return err
+			}
+			if self && old != "" && p.Get(field) != old && tools.ArrayContains(tools.IdentityFields, field) &&
+				commiter.Can(tools.PermProfileManage) == false {
+				return errors.New("Contact customer service to change your " + strings.Replace(field, "_", " ", -1) + ".")
+			}
+		}
+		p.UpdatedAt = time.Now()
+		if _, err := tx.Model(&p).OnConflict("(u_id) DO UPDATE").Insert(); err != nil {
+			return err
+		}
+
+		lang := u.Language
+		if l, ok := changes["lang"]; ok {
+			lang = l
+			if _, err := tx.Model(&u).Set("language = ?", lang).WherePK().Update(); err != nil {
+				return err
+			}
+		}
+		return tools.AuditUser(tx, commiter, "UpdateProfile", u.Id, u.Name, nil, map[string][]string{
+			"changed": profileChanges(before, p, u.Language, lang),
+		})
+	})
+}
@@ -0,0 +1,20 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+)
+
+func TestProfileChanges(t *testing.T) {
+	before := tools.CustomerProfile{LegalName: "Zhang San", City: "Wuhan"}
+	after := before
+	after.City, after.Address = "Beijing", "1 Road"
+	if got := profileChanges(before, after, "en", "zh"); !reflect.DeepEqual(got, []string{"address", "city", "lang"}) {
+		t.Errorf("got %v", got)
+	}
+	if got := profileChanges(before, before, "en", "en"); len(got) != 0 {
+		t.Errorf("got %v", got)
+	}
+}
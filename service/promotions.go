@@ -0,0 +1,335 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// parsePromotionArgs reads the terms of a new promotion: code, description, kind, percent, amount,
+// months, plans (comma-separated), new_customers_only, max_redemptions, and the validity window
+// valid_from and valid_until as YYYY-MM-DD, valid_until excluded.
+func parsePromotionArgs(args url.Values) (tools.Promotion, error) {
+	p := tools.Promotion{Code: strings.ToUpper(strings.TrimSpace(args.Get("code"))), Description: args.Get("description"),
+		Kind: args.Get("kind")}
+	var err error
+	if s := args.Get("percent"); s != "" {
+		if p.Percent, err = strconv.Atoi(s); err != nil {
+			return p, errors.New("Invalid percent: " + s)
+		}
+	}
+	if s := args.Get("amount"); s != "" {
+		if p.Amount, err = tools.StringToMoneyT(s); err != nil {
+			return p, errors.New("Invalid amount: " + s)
+		}
+	}
+	if s := args.Get("months"); s != "" {
+		if p.Months, err = strconv.Atoi(s); err != nil {
+			return p, errors.New("Invalid months: " + s)
+		}
+	}
+	if s := args.Get("max_redemptions"); s != "" {
+		if p.MaxRedemptions, err = strconv.Atoi(s); err != nil {
+			return p, errors.New("Invalid redemption limit: " + s)
+		}
+	}
+	if s := args.Get("new_customers_only"); s != "" {
+		if p.NewCustomersOnly, err = strconv.ParseBool(s); err != nil {
+			return p, errors.New("Invalid new_customers_only: " + s)
+		}
+	}
+	for _, plan := range strings.Split(args.Get("plans"), ",") {
+		if plan = strings.TrimSpace(plan); plan != "" {
+			p.Plans = append(p.Plans, plan)
+		}
+	}
+	if s := args.Get("valid_from"); s != "" {
+		if p.ValidFrom, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+			return p, errors.New("Invalid start date, use YYYY-MM-DD: " + s)
+		}
+	}
+	if s := args.Get("valid_until"); s != "" {
+		if p.ValidUntil, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+			return p, errors.New("Invalid end date, use YYYY-MM-DD: " + s)
+		}
+	}
+	return p, p.Validate()
+}
+
+func formatPromotion(p tools.Promotion) string {
+	return fmt.Sprintf("id=%d&code=%s&kind=%s&terms=%s&months=%d&plans=%s&new_customers_only=%t&redemptions=%d&max_redemptions=%d&valid_from=%s&valid_until=%s&disabled=%s&description=%s",
+		p.Id, p.Code, p.Kind, url.QueryEscape(p.Terms()), p.Months, strings.Join(p.Plans, ","), p.NewCustomersOnly,
+		p.Redemptions, p.MaxRedemptions, formatOptionalTime(p.ValidFrom), formatOptionalTime(p.ValidUntil),
+		formatOptionalTime(p.DisabledAt), url.QueryEscape(p.Description))
+}
+
+func promotionByCode(db orm.DB, code string) (tools.Promotion, error) {
+	var p tools.Promotion
+	err := db.Model(&p).Where("code = ?", strings.ToUpper(code)).Select()
+	if err != nil && err.Error() == tools.PgNotFoundErr {
+		return p, errors.New("Promotion not found: " + code)
+	}
+	return p, err
+}
+
+// CreatePromotion adds a promotion with the terms read by parsePromotionArgs.
+func CreatePromotion(commiter tools.Actor, p tools.Promotion) (tools.PromoidT, error) {
+	if commiter.Can(tools.PermPromotionManage) == false {
+		return 0, errors.New("Permission denied.")
+	}
+	if err := p.Validate(); err != nil {
+		return 0, err
+	}
+	for _, plan := range p.Plans {
+		if _, err := tools.PlannameToInfo(plan); err != nil {
+			return 0, errors.New("Unknown plan: " + plan)
+		}
+	}
+	if _, err := promotionByCode(tools.DB_, p.Code); err == nil {
+		return 0, errors.New("Code already taken.")
+	}
+
+	p.Id, p.Redemptions, p.DisabledAt = 0, 0, time.Time{}
+	p.CreatedBy, p.CreatedAt = commiter.Uid, time.Now()
+	err := tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tx.Insert(&p); err != nil {
+			return err
+		}
+		return tools.Audit(tx, commiter, "CreatePromotion", p.Code, nil, p)
+	})
+	return p.Id, err
+}
+
+// ListPromotions lists one page of the promotions, newest first.
+func ListPromotions(commiter tools.Actor, page Page) (string, error) {
+	if commiter.Can(tools.PermPromotionManage) == false && commiter.Can(tools.PermPromotionRedeem) == false {
+		return "", errors.New("Permission denied.")
+	}
+	if page.Sort == "" {
+		page.Sort, page.Desc = "id", true
+	}
+
+	var promotions []tools.Promotion
+	q, err := page.apply(tools.DB_.Model(&promotions),
+		map[string]string{"id": "id", "code": "code", "redemptions": "redemptions"}, "id", "id")
+	if err != nil {
+		return "", err
+	}
+	total, err := q.SelectAndCount()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+
+	result := page.header(total)
+	for _, p := range promotions {
+		result += formatPromotion(p) + "\n"
+	}
+	return result, nil
+}
+
+// DisablePromotion stops new redemptions of a promotion. Customers who redeemed it keep the discount.
+func DisablePromotion(commiter tools.Actor, code string) error {
+	if commiter.Can(tools.PermPromotionManage) == false {
+		return errors.New("Permission denied.")
+	}
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		p, err := promotionByCode(tx, code)
+		if err != nil {
+			return err
+		}
+		if !p.DisabledAt.IsZero() {
+			return errors.New("The promotion is disabled already.")
+		}
+		before := p
+		p.DisabledAt = time.Now()
+		if _, err := tx.Model(&p).Column("disabled_at").WherePK().Update(); err != nil {
+			return err
+		}
+		return tools.Audit(tx, commiter, "DisablePromotion", p.Code, before, p)
+	})
+}
+
+// RedeemPromotion applies a promotion to a customer's account, checking its validity window,
+// redemption limit and eligibility rules. A sign-up bonus is credited at once, discounts are taken off
+// the next plan fees by billCustomer.
+func RedeemPromotion(commiter tools.Actor, customerUsername, code string) error {
+	if commiter.Can(tools.PermPromotionRedeem) == false {
+		return errors.New("Permission denied.")
+	}
+	u, err := tools.UsernameToInfo(customerUsername)
+	if err != nil {
+		return err
+	}
+	if tools.CheckPermission(u.Id, tools.PermCustomer) == false {
+		return errors.New("Only customer can redeem a promotion.")
+	}
+
+	before := tools.MoneyT(0)
+	var p tools.Promotion
+	err = tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		err := tx.Model(&p).Where("code = ?", strings.ToUpper(code)).For("UPDATE").Select()
+		if err != nil {
+			if err.Error() == tools.PgNotFoundErr {
+				return errors.New("Promotion not found: " + code)
+			}
+			return err
+		}
+		if err := p.Redeemable(time.Now()); err != nil {
+			return err
+		}
+		u, err = lockUser(tx, u.Id)
+		if err != nil {
+			return err
+		}
+		before = u.Balance
+
+		count, err := tx.Model(&tools.PromotionRedemption{}).Where("promotion_id = ? AND u_id = ?", p.Id, u.Id).Count()
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errors.New("The customer has redeemed this promotion already.")
+		}
+		if len(p.Plans) > 0 {
+			plan := tools.PlanInfo{Id: u.Plan}
+			if u.Plan != 0 {
+				if err := tx.Select(&plan); err != nil {
+					return err
+				}
+			}
+			if u.Plan == 0 || !p.AppliesToPlan(plan.Name) {
+				return errors.New("The promotion is only for the plans " + strings.Join(p.Plans, ","))
+			}
+		}
+		if p.NewCustomersOnly {
+			count, err := tx.Model(&tools.Invoice{}).Where("u_id = ?", u.Id).Count()
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return errors.New("The promotion is only for new customers.")
+			}
+		}
+
+		r := tools.PromotionRedemption{PromotionId: p.Id, UId: u.Id, RedeemedBy: commiter.Uid, RedeemedAt: time.Now()}
+		if err := tx.Insert(&r); err != nil {
+			return err
+		}
+		p.Redemptions++
+		if _, err := tx.Model(&p).Column("redemptions").WherePK().Update(); err != nil {
+			return err
+		}
+		if p.Kind == tools.PromoSignupBonus {
+			if err := applyBalanceChange(tx, &u, p.Amount, "signup_bonus", "promotion "+p.Code); err != nil {
+				return err
+			}
+		}
+		return tools.AuditUser(tx, commiter, "RedeemPromotion", u.Id, u.Name, nil, map[string]string{
+			"code": p.Code, "terms": p.Terms(),
+		})
+	})
+
+	if err == nil && u.Balance != before {
+		notifyBalanceChange(u, before, "signup_bonus")
+	}
+	return err
+}
+
+// ListRedemptions shows the promotions redeemed by a customer, and how many periods they discounted.
+func ListRedemptions(commiter tools.Actor, usernameToQuery string) (string, error) {
+	u, err := tools.UsernameToInfo(usernameToQuery)
+	if err != nil {
+		return "", err
+	}
+	if u.Id != commiter.Uid {
+		if commiter.Can(tools.PermBalanceView) == false && commiter.Can(tools.PermPromotionRedeem) == false {
+			return "", errors.New("Permission denied.")
+		}
+	}
+
+	redemptions, promotions, err := redemptionsOf(tools.DB_, u.Id)
+	if err != nil {
+		return "", err
+	}
+	result := ""
+	for _, r := range redemptions {
+		p := promotions[r.PromotionId]
+		result += fmt.Sprintf("code=%s&terms=%s&periods=%d&months=%d&active=%t&redeemed=%s\n",
+			p.Code, url.QueryEscape(p.Terms()), r.Periods, p.Months, r.Active(p), formatOptionalTime(r.RedeemedAt))
+	}
+	return result, nil
+}
+
+// redemptionsOf loads the redemptions of a customer in the order they were made, with their promotions.
+func redemptionsOf(db orm.DB, uid tools.UidT) ([]tools.PromotionRedemption, map[tools.PromoidT]tools.Promotion, error) {
+	var redemptions []tools.PromotionRedemption
+	err := db.Model(&redemptions).Where("u_id = ?", uid).Order("id").Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return nil, nil, err
+	}
+	promotions := make(map[tools.PromoidT]tools.Promotion)
+	if len(redemptions) == 0 {
+		return redemptions, promotions, nil
+	}
+	var ids []tools.PromoidT
+	for _, r := range redemptions {
+		ids = append(ids, r.PromotionId)
+	}
+	var list []tools.Promotion
+	err = db.Model(&list).Where("id IN (?)", pg.In(ids)).Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return nil, nil, err
+	}
+	for _, p := range list {
+		promotions[p.Id] = p
+	}
+	return redemptions, promotions, nil
+}
+
+// discountPlan decides the discounts of one invoice: the active redemptions applying to the plan take
+// off the fee in the order they were made, each at most what the previous ones left. It returns the
+// invoice lines, and the redemptions that took something, whose period counts.
+func discountPlan(plan tools.PlanInfo, redemptions []tools.PromotionRedemption,
+	promotions map[tools.PromoidT]tools.Promotion) ([]tools.InvoiceLine, []tools.PromotionRedemption) {
+	var lines []tools.InvoiceLine
+	var used []tools.PromotionRedemption
+	left := plan.Price
+	for _, r := range redemptions {
+		p := promotions[r.PromotionId]
+		if !r.Active(p) || !p.AppliesToPlan(plan.Name) {
+			continue
+		}
+		d := p.Discount(left)
+		if d == 0 {
+			continue
+		}
+		left -= d
+		lines = append(lines, tools.InvoiceLine{Description: "Promotion " + p.Code + ": " + p.Terms(), Amount: -d})
+		used = append(used, r)
+	}
+	return lines, used
+}
+
+// promotionLines returns the discount lines of a locked customer's plan fee, and counts the period
+// against the redemptions they come from.
+func promotionLines(tx *pg.Tx, uid tools.UidT, plan tools.PlanInfo) ([]tools.InvoiceLine, error) {
+	redemptions, promotions, err := redemptionsOf(tx, uid)
+	if err != nil {
+		return nil, err
+	}
+	lines, used := discountPlan(plan, redemptions, promotions)
+	for _, r := range used {
+		r.Periods++
+		if _, err := tx.Model(&r).Column("periods").WherePK().Update(); err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
+}
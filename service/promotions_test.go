@@ -0,0 +1,65 @@
+package service
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+)
+
+func TestDiscountPlan(t *testing.T) {
+	promotions := map[tools.PromoidT]tools.Promotion{
+		1: {Id: 1, Code: "HALF", Kind: tools.PromoPercent, Percent: 50},
+		2: {Id: 2, Code: "FIVE", Kind: tools.PromoFixed, Amount: 800, Months: 2},
+		3: {Id: 3, Code: "MORE", Kind: tools.PromoFixed, Amount: 100},
+		4: {Id: 4, Code: "PRO", Kind: tools.PromoFixed, Amount: 100, Plans: []string{"pro"}},
+		5: {Id: 5, Code: "BONUS", Kind: tools.PromoSignupBonus, Amount: 100},
+	}
+	plan := tools.PlanInfo{Name: "basic", Price: 1000}
+	var redemptions []tools.PromotionRedemption
+	for id := tools.PromoidT(1); id <= 5; id++ {
+		redemptions = append(redemptions, tools.PromotionRedemption{Id: int64(id), PromotionId: id})
+	}
+
+	lines, used := discountPlan(plan, redemptions, promotions)
+	if len(lines) != 2 || lines[0].Amount != -500 || lines[1].Amount != -500 ||
+		lines[0].Description != "Promotion HALF: 50% off" {
+		t.Errorf("got %+v", lines)
+	}
+	// MORE took nothing, so its period does not count.
+	if len(used) != 2 || used[0].Id != 1 || used[1].Id != 2 {
+		t.Errorf("used %+v", used)
+	}
+
+	// A redemption behind a full discount keeps its months.
+	promotions[1] = tools.Promotion{Id: 1, Code: "FREE", Kind: tools.PromoFreeMonths, Months: 1}
+	if lines, used := discountPlan(plan, redemptions, promotions); len(lines) != 1 || len(used) != 1 || used[0].Id != 1 {
+		t.Errorf("got %+v, used %+v", lines, used)
+	}
+
+	// Used up redemptions take nothing.
+	redemptions[0].Periods, redemptions[1].Periods = 1, 2
+	if lines, used := discountPlan(plan, redemptions, promotions); len(lines) != 1 || lines[0].Amount != -100 || used[0].Id != 3 {
+		t.Errorf("got %+v, used %+v", lines, used)
+	}
+}
+
+func TestParsePromotionArgs(t *testing.T) {
+	args, _ := url.ParseQuery("code=spring&kind=percent&percent=15&months=3&plans=basic,+pro&new_customers_only=true&valid_until=2026-12-31")
+	p, err := parsePromotionArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Code != "SPRING" || p.Percent != 15 || p.Months != 3 || len(p.Plans) != 2 || p.Plans[1] != "pro" ||
+		!p.NewCustomersOnly || p.ValidUntil.Format("2006-01-02") != "2026-12-31" {
+		t.Errorf("got %+v", p)
+	}
+
+	for _, bad := range []string{"code=X1&kind=percent&percent=5", "code=ABC&kind=fixed&amount=ten", "code=ABC&kind=free_months",
+		"code=ABC&kind=percent&percent=5&valid_from=2026-13-01"} {
+		args, _ := url.ParseQuery(bad)
+		if _, err := parsePromotionArgs(args); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
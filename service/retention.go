@@ -0,0 +1,87 @@
+package service
+
+import (
+	"log"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+)
+
+// RetentionYears is how long the personal data of a removed user is kept. The balance log and the
+// invoices are kept for accounting, under the anonymized account.
+var RetentionYears = 7
+var RetentionCheckInterval = 24 * time.Hour
+
+// retentionActor commits the anonymizations of the retention job in the audit log.
+var retentionActor = tools.Actor{Uid: -1, UserAgent: "retention job"}
+
+// anonymizeUser erases the personal data of a removed user: the name, email, profile, notifications and
+// the emails to the user. The audit log cannot be changed; it keeps the name as the target of entries
+// older than the anonymization, but its snapshots hold no profile values and masked emails only.
+func anonymizeUser(uid tools.UidT) error {
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		u, err := lockUser(tx, uid)
+		if err != nil {
+			return err
+		}
+		if u.Status != tools.StatusRemoved || !u.AnonymizedAt.IsZero() {
+			return nil
+		}
+		email := u.Email
+
+		u.Name = tools.ArchivedName(u.Id)
+		u.Email = ""
+		u.Password = ""
+		u.TotpSecret = ""
+		u.TotpEnabled = false
+		u.Language = tools.DefaultLanguage
+		u.AnonymizedAt = time.Now()
+		if err := tx.Update(&u); err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&tools.CustomerProfile{}, &tools.NotificationSettings{}, &tools.Notification{}, &tools.RecoveryCode{}} {
+			if _, err := tx.Model(model).Where("u_id = ?", uid).Delete(); err != nil {
+				return err
+			}
+		}
+		if email != "" {
+			if _, err := tx.Model(&tools.OutboxEmail{}).Where(`"to" = ?`, email).Delete(); err != nil {
+				return err
+			}
+		}
+		return tools.AuditUser(tx, retentionActor, "AnonymizeUser", u.Id, u.Name, nil, nil)
+	})
+}
+
+// RunRetention anonymizes the users removed longer than RetentionYears ago.
+func RunRetention() error {
+	var users []tools.UserInfo
+	err := tools.DB_.Model(&users).Column("id").
+		Where("status = ? AND removed_at < ? AND anonymized_at IS NULL", tools.StatusRemoved, time.Now().AddDate(-RetentionYears, 0, 0)).
+		Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return err
+	}
+
+	for _, u := range users {
+		if err := anonymizeUser(u.Id); err != nil {
+			return err
+		}
+	}
+	if len(users) > 0 {
+		log.Printf("Anonymized %d removed user(s).", len(users))
+	}
+	return nil
+}
+
+// RunRetentionWorker runs the retention job periodically. It never returns.
+func RunRetentionWorker() {
+	for {
+		if err := RunRetention(); err != nil {
+			log.Print("Retention job failed. " + err.Error())
+		}
+		time.Sleep(RetentionCheckInterval)
+	}
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+)
+
+func grantNames(grants []tools.RoleGrant) string {
+	strs := make([]string, len(grants))
+	for i, g := range grants {
+		strs[i] = g.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+func ListRoles(commiter tools.Actor) (string, error) {
+	if commiter.Can(tools.PermRoleManage) == false && commiter.Can(tools.PermUserView) == false {
+		return "", errors.New("Permission denied.")
+	}
+
+	var roles []tools.Role
+	err := tools.DB_.Model(&roles).Order("name").Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+	var grants []tools.RoleGrant
+	err = tools.DB_.Model(&grants).Order("id").Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+	grantsOf := make(map[string][]tools.RoleGrant)
+	for _, g := range grants {
+		grantsOf[g.Role] = append(grantsOf[g.Role], g)
+	}
+
+	result := ""
+	for _, r := range roles {
+		result += fmt.Sprintf("role=%s&builtin=%t&require_totp=%t&description=%s&grants=%s\n",
+			r.Name, r.Builtin, r.RequireTotp, url.QueryEscape(r.Description), grantNames(grantsOf[r.Name]))
+	}
+	return result, nil
+}
+
+// customRole loads a role that may be edited: it must exist and not be built in.
+func customRole(tx *pg.Tx, name string) (tools.Role, []tools.RoleGrant, error) {
+	role := tools.Role{Name: name}
+	err := tx.Model(&role).WherePK().For("UPDATE").Select()
+	if err != nil {
+		if err.Error() == tools.PgNotFoundErr {
+			return role, nil, errors.New("Role not found: " + name)
+		}
+		return role, nil, err
+	}
+	if role.Builtin {
+		return role, nil, errors.New("Built-in roles cannot be changed.")
+	}
+
+	var grants []tools.RoleGrant
+	err = tx.Model(&grants).Where("role = ?", name).Order("id").Select()
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return role, nil, err
+	}
+	return role, grants, nil
+}
+
+func roleSnapshot(role tools.Role, grants []tools.RoleGrant) map[string]string {
+	return map[string]string{"description": role.Description, "grants": grantNames(grants)}
+}
+
+// CreateRole adds a custom role. grantsStr is a permission list as read by tools.ParseGrants.
+func CreateRole(commiter tools.Actor, name, description, grantsStr string) error {
+	if commiter.Can(tools.PermRoleManage) == false {
+		return errors.New("Permission denied.")
+	}
+	if !tools.RoleNameRegex.MatchString(name) {
+		return errors.New("Invalid role name. Use 1 to 32 lowercase letters, digits and '_'.")
+	}
+	grants, err := tools.ParseGrants(name, grantsStr)
+	if err != nil {
+		return err
+	}
+	if len(grants) == 0 {
+		return errors.New("A role must grant at least one permission.")
+	}
+
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		role := tools.Role{Name: name, Description: description}
+		res, err := tx.Model(&role).OnConflict("DO NOTHING").Insert()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return errors.New("Role already exists: " + name)
+		}
+		if err := tx.Insert(&grants); err != nil {
+			return err
+		}
+		return tools.Audit(tx, commiter, "CreateRole", name, nil, roleSnapshot(role, grants))
+	})
+}
+
+// UpdateRole replaces the description and the grants of a custom role. Its members are affected at once.
+func UpdateRole(commiter tools.Actor, name, description, grantsStr string) error {
+	if commiter.Can(tools.PermRoleManage) == false {
+		return errors.New("Permission denied.")
+	}
+	grants, err := tools.ParseGrants(name, grantsStr)
+	if err != nil {
+		return err
+	}
+	if len(grants) == 0 {
+		return errors.New("A role must grant at least one permission.")
+	}
+
+	defer tools.InvalidateAllGrants()
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		role, oldGrants, err := customRole(tx, name)
+		if err != nil {
+			return err
+		}
+		before := roleSnapshot(role, oldGrants)
+
+		role.Description = description
+		if err := tx.Update(&role); err != nil {
+			return err
+		}
+		if _, err := tx.Model(&tools.RoleGrant{}).Where("role = ?", name).Delete(); err != nil {
+			return err
+		}
+		if err := tx.Insert(&grants); err != nil {
+			return err
+		}
+		return tools.Audit(tx, commiter, "UpdateRole", name, before, roleSnapshot(role, grants))
+	})
+}
+
+// DeleteRole removes a custom role that no user holds anymore.
+func DeleteRole(commiter tools.Actor, name string) error {
+	if commiter.Can(tools.PermRoleManage) == false {
+		return errors.New("Permission denied.")
+	}
+
+	defer tools.InvalidateAllGrants()
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		role, grants, err := customRole(tx, name)
+		if err != nil {
+			return err
+		}
+
+		members, err := tx.Model(&tools.UserInfo{}).Where("? = ANY(roles) AND status <> ?", name, tools.StatusRemoved).Count()
+		if err != nil {
+			return err
+		}
+		if members > 0 {
+			return fmt.Errorf("The role is still held by %d user(s).", members)
+		}
+
+		if _, err := tx.Model(&tools.RoleGrant{}).Where("role = ?", name).Delete(); err != nil {
+			return err
+		}
+		if err := tx.Delete(&role); err != nil {
+			return err
+		}
+		return tools.Audit(tx, commiter, "DeleteRole", name, roleSnapshot(role, grants), nil)
+	})
+}
+
+// SetUserRoles replaces the roles of a user. The commiter must be allowed to manage the user both
+// with its current roles and with the new ones.
+func SetUserRoles(commiter tools.Actor, username, roleNames string) error {
+	u, err := tools.UsernameToInfo(username)
+	if err != nil {
+		return err
+	}
+	if u.Id == tools.RootUid {
+		return errors.New("The roles of root cannot be changed.")
+	}
+
+	roles, err := tools.ParseRoles(roleNames)
+	if err != nil {
+		return err
+	}
+	if checkUserUpdatePermission(commiter, u.Roles) == false || checkUserUpdatePermission(commiter, roles) == false {
+		return errors.New("Permission denied.")
+	}
+
+	defer tools.InvalidateGrants(u.Id)
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		before := map[string][]string{"roles": u.Roles}
+		_, err := tx.Model(&u).Set("roles = ?", pg.Array(roles)).WherePK().Update()
+		if err != nil {
+			return err
+		}
+		return tools.AuditUser(tx, commiter, "SetUserRoles", u.Id, u.Name, before, map[string][]string{"roles": roles})
+	})
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+)
+
+const minSearchLength = 2
+
+type searchHit struct {
+	Id     tools.UidT
+	Name   string
+	Email  string
+	Number string
+	Score  float64
+	Total  int
+}
+
+// digitsOf keeps the digits of a query, so that `138-0013 8000` finds 13800138000.
+func digitsOf(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// SearchUsers finds users by part of their name, email or phone number, best matches first. Names and
+// emails are ranked by trigram similarity, a phone number containing the digits of the query ranks first.
+// Staff who may view profiles also find users by part of their ID document number.
+func SearchUsers(commiter tools.Actor, query string, page Page) (string, error) {
+	if commiter.Can(tools.PermUserView) == false {
+		return "", errors.New("Permission denied.")
+	}
+	query = strings.TrimSpace(query)
+	if len([]rune(query)) < minSearchLength {
+		return "", fmt.Errorf("Type at least %d characters.", minSearchLength)
+	}
+	if page.Sort != "" {
+		return "", errors.New("Search results are sorted by relevance.")
+	}
+
+	// An impossible pattern when the query has too few digits to look like part of a phone number.
+	numberPattern := "-"
+	if digits := digitsOf(query); len(digits) >= 3 {
+		numberPattern = "%" + digits + "%"
+	}
+
+	byIdNumber := commiter.Can(tools.PermProfileView) && len(query) >= 4
+
+	const matches = `
+		FROM user_infos u
+		LEFT JOIN phone_numbers n ON n.u_id = u.id AND n.state = ?2
+		LEFT JOIN customer_profiles p ON p.u_id = u.id
+		WHERE u.status <> ?7 AND (u.name ILIKE ?3 OR u.email ILIKE ?3 OR u.name % ?0 OR u.email % ?0
+			OR n.number LIKE ?1 OR (?6 AND p.id_number ILIKE ?3))`
+	params := []interface{}{query, numberPattern, tools.NumberAssigned, likeContains(query), page.Offset, page.Limit,
+		byIdNumber, tools.StatusRemoved}
+
+	var hits []searchHit
+	_, err := tools.DB_.Query(&hits, `
+		SELECT u.id, u.name, u.email, n.number, count(*) OVER () AS total,
+			GREATEST(similarity(u.name, ?0), similarity(coalesce(u.email, ''), ?0),
+				CASE WHEN n.number LIKE ?1 OR (?6 AND p.id_number ILIKE ?3) THEN 1 ELSE 0 END) AS score`+matches+`
+		ORDER BY score DESC, u.name
+		OFFSET ?4 LIMIT ?5`, params...)
+	if err != nil && err.Error() != tools.PgNotFoundErr {
+		return "", err
+	}
+
+	total := 0
+	if len(hits) > 0 {
+		total = hits[0].Total
+	} else if page.Offset > 0 {
+		// Past the last page the window count has no row to ride on.
+		_, err := tools.DB_.QueryOne(pg.Scan(&total), `SELECT count(*)`+matches, params...)
+		if err != nil {
+			return "", err
+		}
+	}
+	result := page.header(total)
+	for _, h := range hits {
+		result += fmt.Sprintf("name=%s&email=%s&number=%s&score=%.2f\n", h.Name, h.Email, h.Number, h.Score)
+	}
+	return result, nil
+}
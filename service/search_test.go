@@ -0,0 +1,12 @@
+package service
+
+import "testing"
+
+func TestDigitsOf(t *testing.T) {
+	cases := map[string]string{"138-0013 8000": "13800138000", "+86 (10)": "8610", "alice": ""}
+	for in, want := range cases {
+		if got := digitsOf(in); got != want {
+			t.Errorf("digitsOf(%q): got %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+)
+
+// sessionOwner resolves the user whose sessions are listed or revoked. Users see their own sessions,
+// staff those of the users they may manage.
+func sessionOwner(commiter tools.Actor, username string) (tools.UserInfo, error) {
+	u, err := tools.UsernameToInfo(username)
+	if err != nil {
+		return u, err
+	}
+	if u.Id != commiter.Uid && checkUserUpdatePermission(commiter, u.Roles) == false {
+		return u, errors.New("Permission denied.")
+	}
+	return u, nil
+}
+
+func ListSessions(commiter tools.Actor, username string) (string, error) {
+	u, err := sessionOwner(commiter, username)
+	if err != nil {
+		return "", err
+	}
+
+	result := ""
+	for _, s := range tools.UserSessions(u.Id) {
+		result += fmt.Sprintf("id=%s&created=%s&last_seen=%s&expires=%s&ip=%s&last_ip=%s&user_agent=%s&impersonator=%d&current=%t\n",
+			s.Id, s.Created.Format(time.RFC3339), s.LastSeen.Format(time.RFC3339), s.Expires().Format(time.RFC3339),
+			s.Ip, s.LastIp, url.QueryEscape(s.UserAgent), s.Impersonator, u.Id == commiter.Uid && s.Id == commiter.Session)
+	}
+	return result, nil
+}
+
+func RevokeSession(commiter tools.Actor, username, id string) error {
+	u, err := sessionOwner(commiter, username)
+	if err != nil {
+		return err
+	}
+	if err := tools.RevokeSession(u.Id, id); err != nil {
+		return err
+	}
+	return tools.AuditUser(tools.DB_, commiter, "RevokeSession", u.Id, u.Name, nil, map[string]string{"session": id})
+}
+
+// LogoutEverywhere ends every session of a user, the one of the commiter included.
+func LogoutEverywhere(commiter tools.Actor, username string) error {
+	u, err := sessionOwner(commiter, username)
+	if err != nil {
+		return err
+	}
+	count := tools.RevokeUserSessions(u.Id)
+	return tools.AuditUser(tools.DB_, commiter, "LogoutEverywhere", u.Id, u.Name, nil, map[string]int{"sessions": count})
+}
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+)
+
+const maxSimsPerBatch = 10000
+
+// parseSimCsv reads a supplier batch with the columns iccid,imsi,pin,puk. A header line is allowed.
+func parseSimCsv(content string) ([]tools.SimCard, error) {
+	reader := csv.NewReader(strings.NewReader(content))
+	reader.FieldsPerRecord = 4
+	reader.TrimLeadingSpace = true
+
+	var sims []tools.SimCard
+	seen := make(map[string]bool)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.EqualFold(record[0], "iccid") {
+			continue
+		}
+
+		sim := tools.SimCard{
+			Iccid: record[0],
+			Imsi:  record[1],
+			Pin:   record[2],
+			Puk:   record[3],
+			State: tools.SimInStock,
+		}
+		switch {
+		case !tools.IccidRegex.MatchString(sim.Iccid):
+			return nil, fmt.Errorf("Line %d: invalid ICCID.", line)
+		case !tools.ImsiRegex.MatchString(sim.Imsi):
+			return nil, fmt.Errorf("Line %d: invalid IMSI.", line)
+		case !tools.SimPinRegex.MatchString(sim.Pin):
+			return nil, fmt.Errorf("Line %d: invalid PIN.", line)
+		case !tools.SimPukRegex.MatchString(sim.Puk):
+			return nil, fmt.Errorf("Line %d: invalid PUK.", line)
+		case seen[sim.Iccid] || seen[sim.Imsi]:
+			return nil, fmt.Errorf("Line %d: duplicated ICCID or IMSI.", line)
+		}
+		seen[sim.Iccid] = true
+		seen[sim.Imsi] = true
+		sims = append(sims, sim)
+	}
+
+	if len(sims) == 0 {
+		return nil, errors.New("The batch is empty.")
+	}
+	if len(sims) > maxSimsPerBatch {
+		return nil, fmt.Errorf("A batch must contain at most %d SIM cards.", maxSimsPerBatch)
+	}
+	return sims, nil
+}
+
+// ImportSimBatch adds a whole supplier batch to the stock, or nothing if any card is invalid or already known.
+func ImportSimBatch(commiter tools.Actor, content string) (int, error) {
+	if commiter.Can(tools.PermSimManage) == false {
+		return 0, errors.New("Permission denied.")
+	}
+
+	sims, err := parseSimCsv(content)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tx.Insert(&sims); err != nil {
+			return err
+		}
+		return tools.Audit(tx, commiter, "ImportSimBatch", sims[0].Iccid+"-"+sims[len(sims)-1].Iccid,
+			nil, map[string]int{"imported": len(sims)})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(sims), nil
+}
+
+func simToCustomer(commiter tools.Actor, customerUsername string) (tools.UserInfo, string, error) {
+	if commiter.Can(tools.PermSimManage) == false {
+		return tools.UserInfo{}, "", errors.New("Permission denied.")
+	}
+
+	u, err := tools.UsernameToInfo(customerUsername)
+	if err != nil {
+		return u, "", err
+	}
+	if tools.CheckPermission(u.Id, tools.PermCustomer) == false {
+		return u, "", errors.New("Only customer can have a SIM card.")
+	}
+
+	number, err := assignedNumberOf(u.Id)
+	if err != nil {
+		return u, "", err
+	}
+	if number == "" {
+		return u, "", errors.New("The customer has no subscriber line.")
+	}
+	return u, number, nil
+}
+
+// activateSim pairs an in-stock card with a subscriber line.
+func activateSim(tx *pg.Tx, iccid string, uid tools.UidT, number string) error {
+	sim := tools.SimCard{Iccid: iccid}
+	err := tx.Model(&sim).WherePK().For("UPDATE").Select()
+	if err != nil {
+		if err.Error() == tools.PgNotFoundErr {
+			return errors.New("SIM card not found: " + iccid)
+		}
+		return err
+	}
+	if sim.State != tools.SimInStock {
+		return errors.New("SIM card is not in stock: " + iccid)
+	}
+
+	sim.State = tools.SimActivated
+	sim.UId = uid
+	sim.Number = number
+	sim.ActivatedAt = time.Now()
+	return tx.Update(&sim)
+}
+
+func PairSim(commiter tools.Actor, customerUsername, iccid string) error {
+	u, number, err := simToCustomer(commiter, customerUsername)
+	if err != nil {
+		return err
+	}
+
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		count, err := tx.Model(&tools.SimCard{}).
+			Where("u_id = ? AND state IN (?, ?)", u.Id, tools.SimActivated, tools.SimLost).Count()
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errors.New("The customer already has a SIM card. Swap it instead.")
+		}
+		if err := activateSim(tx, iccid, u.Id, number); err != nil {
+			return err
+		}
+		return tools.AuditUser(tx, commiter, "PairSim", u.Id, u.Name, nil, map[string]string{"iccid": iccid, "number": number})
+	})
+}
+
+// SwapSim blocks the customer's current card, recording why, and activates a new one on the same line.
+func SwapSim(commiter tools.Actor, customerUsername, newIccid, reason string) error {
+	u, number, err := simToCustomer(commiter, customerUsername)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reason) == "" {
+		return errors.New("A reason is required to swap a SIM card.")
+	}
+	oldIccid, err := activeSimOf(u.Id)
+	if err != nil {
+		return err
+	}
+
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if err := blockSims(tx, u.Id, reason); err != nil {
+			return err
+		}
+		if err := activateSim(tx, newIccid, u.Id, number); err != nil {
+			return err
+		}
+		return tools.AuditUser(tx, commiter, "SwapSim", u.Id, u.Name,
+			map[string]string{"iccid": oldIccid}, map[string]string{"iccid": newIccid, "reason": reason})
+	})
+}
+
+// ReportSimLost marks the customer's active card as lost until it is swapped.
+func ReportSimLost(commiter tools.Actor, customerUsername string) error {
+	u, _, err := simToCustomer(commiter, customerUsername)
+	if err != nil {
+		return err
+	}
+
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		sim := tools.SimCard{}
+		err := tx.Model(&sim).Where("u_id = ? AND state = ?", u.Id, tools.SimActivated).For("UPDATE").First()
+		if err != nil {
+			if err.Error() == tools.PgNotFoundErr {
+				return errors.New("The customer has no active SIM card.")
+			}
+			return err
+		}
+
+		sim.State = tools.SimLost
+		if err := tx.Update(&sim); err != nil {
+			return err
+		}
+		return tools.AuditUser(tx, commiter, "ReportSimLost", u.Id, u.Name,
+			map[string]string{"iccid": sim.Iccid, "state": tools.SimActivated}, map[string]string{"iccid": sim.Iccid, "state": tools.SimLost})
+	})
+}
+
+// blockSims blocks the customer's current cards, recording the reason.
+func blockSims(tx *pg.Tx, uid tools.UidT, reason string) error {
+	_, err := tx.Model(&tools.SimCard{}).
+		Set("state = ?, block_reason = ?, blocked_at = ?", tools.SimBlocked, reason, time.Now()).
+		Where("u_id = ? AND state IN (?, ?)", uid, tools.SimActivated, tools.SimLost).
+		Update()
+	return err
+}
+
+// activeSimOf returns the ICCID of the customer's current card, or an empty string.
+func activeSimOf(uid tools.UidT) (string, error) {
+	sim := tools.SimCard{}
+	err := tools.DB_.Model(&sim).Where("u_id = ? AND state IN (?, ?)", uid, tools.SimActivated, tools.SimLost).First()
+	if err != nil {
+		if err.Error() == tools.PgNotFoundErr {
+			return "", nil
+		}
+		return "", err
+	}
+	return sim.Iccid, nil
+}
@@ -0,0 +1,28 @@
+package service
+
+import "testing"
+
+func TestParseSimCsv(t *testing.T) {
+	sims, err := parseSimCsv("iccid,imsi,pin,puk\n8986001234567890123,460001234567890,1234,12345678\n89860012345678901234, 460001234567891,0000,87654321\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(sims) != 2 || sims[1].Imsi != "460001234567891" || sims[0].Puk != "12345678" {
+		t.Error("parse sim csv boom")
+	}
+
+	bad := []string{
+		"",
+		"8986001234567890123,460001234567890,1234\n",
+		"898600123456789012,460001234567890,1234,12345678\n",
+		"8986001234567890123,46000123456789,1234,12345678\n",
+		"8986001234567890123,460001234567890,12,12345678\n",
+		"8986001234567890123,460001234567890,1234,1234\n",
+		"8986001234567890123,460001234567890,1234,12345678\n8986001234567890123,460001234567899,1234,12345678\n",
+	}
+	for _, content := range bad {
+		if _, err := parseSimCsv(content); err == nil {
+			t.Error("bad batch accepted: " + content)
+		}
+	}
+}
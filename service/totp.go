@@ -0,0 +1,144 @@
+package service
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/Chips-zhang/DBProjectHust/tools"
+	"github.com/go-pg/pg"
+)
+
+func selfOf(commiter tools.Actor) (tools.UserInfo, error) {
+	u := tools.UserInfo{Id: commiter.Uid}
+	err := tools.DB_.Select(&u)
+	return u, err
+}
+
+// BeginTotpEnrollment gives the commiter a new TOTP secret, enabled by ConfirmTotpEnrollment.
+func BeginTotpEnrollment(commiter tools.Actor) (string, error) {
+	u, err := selfOf(commiter)
+	if err != nil {
+		return "", err
+	}
+	if u.TotpEnabled {
+		return "", errors.New("TOTP is already enabled.")
+	}
+
+	secret, err := tools.GenerateTotpSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = tools.DB_.Model(&u).Set("totp_secret = ?", secret).WherePK().Update()
+	if err != nil {
+		return "", err
+	}
+	return "secret=" + secret + "&url=" + url.QueryEscape(tools.TotpUrl(u.Name, secret)), nil
+}
+
+// ConfirmTotpEnrollment enables TOTP with the first code of the new secret and returns the recovery codes.
+func ConfirmTotpEnrollment(commiter tools.Actor, code string) (string, error) {
+	u, err := selfOf(commiter)
+	if err != nil {
+		return "", err
+	}
+
+	codes, err := tools.EnableTotp(u, code)
+	if err != nil {
+		return "", err
+	}
+	if err := tools.AuditUser(tools.DB_, commiter, "EnableTotp", u.Id, u.Name, nil, nil); err != nil {
+		return "", err
+	}
+	return "recovery_codes=" + strings.Join(codes, ","), nil
+}
+
+// RegenerateRecoveryCodes replaces the commiter's recovery codes, after checking its second factor.
+func RegenerateRecoveryCodes(commiter tools.Actor, code string) (string, error) {
+	u, err := selfOf(commiter)
+	if err != nil {
+		return "", err
+	}
+	if !u.TotpEnabled {
+		return "", errors.New("TOTP is not enabled.")
+	}
+
+	var codes []string
+	err = tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if !tools.CheckSecondFactor(tx, u, code) {
+			return errors.New("Invalid code.")
+		}
+		var err error
+		codes, err = tools.ResetRecoveryCodes(tx, u.Id)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return "recovery_codes=" + strings.Join(codes, ","), nil
+}
+
+// DisableTotp turns the second factor off. Users disable their own with a current code, unless a role
+// requires it. Staff allowed to manage a user reset it for users who lost both the authenticator and the
+// recovery codes; a user whose role requires TOTP enrolls again at the next login.
+func DisableTotp(commiter tools.Actor, username, code string) error {
+	u, err := tools.UsernameToInfo(username)
+	if err != nil {
+		return err
+	}
+	if !u.TotpEnabled && u.TotpSecret == "" {
+		return errors.New("TOTP is not enabled.")
+	}
+
+	self := u.Id == commiter.Uid
+	if self {
+		required, err := tools.TotpRequired(u)
+		if err != nil {
+			return err
+		}
+		if required {
+			return errors.New("A role of yours requires TOTP.")
+		}
+	} else if checkUserUpdatePermission(commiter, u.Roles) == false {
+		return errors.New("Permission denied.")
+	}
+
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if self && u.TotpEnabled && !tools.CheckSecondFactor(tx, u, code) {
+			return errors.New("Invalid code.")
+		}
+		_, err := tx.Model(&u).Set("totp_secret = NULL, totp_enabled = FALSE").WherePK().Update()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Model(&tools.RecoveryCode{}).Where("u_id = ?", u.Id).Delete(); err != nil {
+			return err
+		}
+		return tools.AuditUser(tx, commiter, "DisableTotp", u.Id, u.Name, nil, nil)
+	})
+}
+
+// SetRoleTotpRequirement makes TOTP mandatory, or optional, for every member of a role.
+func SetRoleTotpRequirement(commiter tools.Actor, roleName string, required bool) error {
+	if commiter.Can(tools.PermRoleManage) == false {
+		return errors.New("Permission denied.")
+	}
+
+	return tools.DB_.RunInTransaction(func(tx *pg.Tx) error {
+		role := tools.Role{Name: roleName}
+		err := tx.Model(&role).WherePK().For("UPDATE").Select()
+		if err != nil {
+			if err.Error() == tools.PgNotFoundErr {
+				return errors.New("Role not found: " + roleName)
+			}
+			return err
+		}
+
+		before := map[string]bool{"require_totp": role.RequireTotp}
+		_, err = tx.Model(&role).Set("require_totp = ?", required).WherePK().Update()
+		if err != nil {
+			return err
+		}
+		return tools.Audit(tx, commiter, "SetRoleTotpRequirement", roleName, before, map[string]bool{"require_totp": required})
+	})
+}
@@ -0,0 +1,35 @@
+package tools
+
+import "context"
+
+// Actor is who commits an operation, with the permissions resolved for the request, and where the
+// request came from. ApiKey names the key of a request made by a service, Session the session of
+// a request made by a logged in user. Impersonator is the operator behind a read-only session as the user.
+type Actor struct {
+	Uid          UidT
+	Grants       Grants
+	Ip           string
+	UserAgent    string
+	ApiKey       string
+	Session      string
+	Impersonator UidT
+}
+
+func (a Actor) Can(perm string) bool {
+	return a.Grants.Has(perm)
+}
+
+type actorContextKey struct{}
+
+// WithActor carries the principal of a request in its context.
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// ActorFrom returns the principal stored by WithActor, or an anonymous actor.
+func ActorFrom(ctx context.Context) Actor {
+	if actor, ok := ctx.Value(actorContextKey{}).(Actor); ok {
+		return actor
+	}
+	return Actor{Uid: -1}
+}
@@ -0,0 +1,178 @@
+package tools
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/orm"
+)
+
+// API keys read `tmk_<prefix>_<secret>`. The prefix finds the key, only a hash of the whole key is stored.
+const apiKeyScheme = "tmk"
+
+var ErrInvalidApiKey = errors.New("Invalid API key.")
+
+// ApiKey authenticates a service, such as a payment kiosk, as its owner: a user standing for the service.
+// The key holds at most the Permissions it lists, and never more than its owner.
+type ApiKey struct {
+	Id          int64     `sql:",pk,unique"`
+	Name        string    `sql:",notnull,unique"`
+	OwnerUid    UidT      `sql:",notnull"`
+	Prefix      string    `sql:",notnull,unique"`
+	KeyHash     string    `sql:",notnull"`
+	Permissions string    `sql:",notnull"` // as read by ParseGrants
+	AllowedIps  []string  `sql:",array"`   // addresses or CIDR ranges, none meaning any
+	ExpiresAt   time.Time // zero for keys that do not expire
+	CreatedAt   time.Time `sql:",notnull"`
+	LastUsedAt  time.Time
+	RevokedAt   time.Time
+}
+
+func (k ApiKey) String() string {
+	return fmt.Sprintf("ApiKey<%s %d %s>", k.Name, k.OwnerUid, k.Prefix)
+}
+
+// apiKeyTouchInterval limits how often the use of a key is written back to the database.
+const apiKeyTouchInterval = time.Minute
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateApiKey returns a new key and the prefix and hash to store.
+func GenerateApiKey() (key, prefix, hash string, err error) {
+	raw := make([]byte, 24)
+	if _, err = rand.Read(raw); err != nil {
+		return
+	}
+	prefix = hex.EncodeToString(raw[:4])
+	key = apiKeyScheme + "_" + prefix + "_" + hex.EncodeToString(raw[4:])
+	return key, prefix, hashApiKey(key), nil
+}
+
+func apiKeyPrefix(key string) (string, bool) {
+	parts := strings.Split(key, "_")
+	if len(parts) != 3 || parts[0] != apiKeyScheme || parts[1] == "" || parts[2] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// ParseIpAllowlist reads a comma-separated list of addresses and CIDR ranges.
+func ParseIpAllowlist(s string) ([]string, error) {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if net.ParseIP(item) == nil {
+			if _, _, err := net.ParseCIDR(item); err != nil {
+				return nil, errors.New("Invalid address or CIDR range: " + item)
+			}
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
+
+func ipAllowed(allowlist []string, ip string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, item := range allowlist {
+		if _, network, err := net.ParseCIDR(item); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if allowed := net.ParseIP(item); allowed != nil && allowed.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RestrictGrants keeps the owner grants that the limit also lists, under the stricter of both caps.
+func RestrictGrants(owner Grants, limit []RoleGrant) Grants {
+	grants := make(Grants)
+	for _, l := range limit {
+		max, ok := owner[l.Permission]
+		if !ok {
+			continue
+		}
+		if l.MaxAmount != 0 && (max == 0 || l.MaxAmount < max) {
+			max = l.MaxAmount
+		}
+		grants[l.Permission] = max
+	}
+	return grants
+}
+
+// VerifyApiKey authenticates a request made with an API key from the given address, and resolves
+// the permissions it holds.
+func VerifyApiKey(key, ip string) (ApiKey, Grants, error) {
+	k := ApiKey{}
+	prefix, ok := apiKeyPrefix(key)
+	if !ok {
+		return k, nil, ErrInvalidApiKey
+	}
+	err := DB_.Model(&k).Where("prefix = ?", prefix).Select()
+	if err != nil {
+		if err.Error() == PgNotFoundErr {
+			return k, nil, ErrInvalidApiKey
+		}
+		return k, nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashApiKey(key)), []byte(k.KeyHash)) != 1 {
+		return k, nil, ErrInvalidApiKey
+	}
+
+	now := time.Now()
+	if !k.RevokedAt.IsZero() {
+		return k, nil, errors.New("The API key is revoked.")
+	}
+	if !k.ExpiresAt.IsZero() && now.After(k.ExpiresAt) {
+		return k, nil, errors.New("The API key is expired.")
+	}
+	if !ipAllowed(k.AllowedIps, ip) {
+		return k, nil, errors.New("The API key is not allowed from " + ip)
+	}
+
+	limit, err := ParseGrants("", k.Permissions)
+	if err != nil {
+		return k, nil, err
+	}
+	owner, err := UserGrants(k.OwnerUid)
+	if err != nil {
+		return k, nil, err
+	}
+
+	if now.Sub(k.LastUsedAt) > apiKeyTouchInterval {
+		_, err = DB_.Model(&k).Set("last_used_at = ?", now).WherePK().Update()
+		if err != nil {
+			return k, nil, err
+		}
+	}
+	return k, RestrictGrants(owner, limit), nil
+}
+
+// RevokeApiKeysOf revokes every key acting as a user, such as a removed one.
+func RevokeApiKeysOf(db orm.DB, uid UidT) error {
+	_, err := db.Model(&ApiKey{}).
+		Set("revoked_at = ?", time.Now()).
+		Where("owner_uid = ? AND revoked_at IS NULL", uid).
+		Update()
+	return err
+}
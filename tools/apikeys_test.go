@@ -0,0 +1,63 @@
+package tools
+
+import "testing"
+
+func TestGenerateApiKey(t *testing.T) {
+	key, prefix, hash, err := GenerateApiKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := apiKeyPrefix(key); !ok || p != prefix {
+		t.Errorf("prefix of %s: got %s, want %s", key, p, prefix)
+	}
+	if hashApiKey(key) != hash {
+		t.Error("hash does not match the key")
+	}
+	for _, bad := range []string{"", "tmk", "tmk__x", "abc_1234_5678", "tmk_1234_5678_9"} {
+		if _, ok := apiKeyPrefix(bad); ok {
+			t.Errorf("malformed key %q accepted", bad)
+		}
+	}
+}
+
+func TestIpAllowlist(t *testing.T) {
+	list, err := ParseIpAllowlist("10.0.0.0/8, 192.168.1.5,")
+	if err != nil || len(list) != 2 {
+		t.Fatalf("got %v, %v", list, err)
+	}
+	if _, err := ParseIpAllowlist("10.0.0.0/33"); err == nil {
+		t.Error("invalid range accepted")
+	}
+
+	cases := map[string]bool{"10.1.2.3": true, "192.168.1.5": true, "192.168.1.6": false, "": false}
+	for ip, want := range cases {
+		if ipAllowed(list, ip) != want {
+			t.Errorf("ipAllowed(%q) should be %t", ip, want)
+		}
+	}
+	if !ipAllowed(nil, "8.8.8.8") {
+		t.Error("an empty allowlist should allow any address")
+	}
+}
+
+func TestRestrictGrants(t *testing.T) {
+	owner := Grants{PermBalanceTopup: 0, PermBalanceView: 0, PermUserView: 0, PermPlanManage: 5000}
+	limit, err := ParseGrants("", "balance.topup:100.00,balance.view,plan.manage,sim.manage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := RestrictGrants(owner, limit)
+
+	if len(g) != 3 {
+		t.Errorf("got %v", g)
+	}
+	if g.Has(PermUserView) || g.Has(PermSimManage) {
+		t.Error("a key should hold only what both the owner and the key list")
+	}
+	if g[PermBalanceTopup] != 10000 {
+		t.Errorf("the cap of the key should apply, got %d", g[PermBalanceTopup])
+	}
+	if g[PermPlanManage] != 5000 {
+		t.Errorf("the cap of the owner should apply, got %d", g[PermPlanManage])
+	}
+}
@@ -0,0 +1,92 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/orm"
+)
+
+// AuditEntry records one privileged operation. Before and After are JSON snapshots of the target.
+// The log is append-only: no API changes an entry, and the table rules drop UPDATE and DELETE.
+type AuditEntry struct {
+	Id        int64  `sql:",pk,unique"`
+	ActorUid  UidT   `sql:",notnull"`
+	Action    string `sql:",notnull"`
+	Target    string
+	TargetUid UidT // the user the entry is about, 0 when it is not about a user
+	Before    string
+	After     string
+	SourceIp  string
+	UserAgent string
+	ApiKey    string
+	Time      time.Time `sql:",notnull"`
+}
+
+func (e AuditEntry) String() string {
+	return fmt.Sprintf("AuditEntry<%d %d %s %s>", e.Id, e.ActorUid, e.Action, e.Target)
+}
+
+// auditSnapshot encodes a value for AuditEntry.Before or After. nil means there is nothing to record.
+func auditSnapshot(v interface{}) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// Audit appends an entry to the audit log. Pass the transaction of the audited change, so that
+// the entry exists if and only if the change is committed.
+func Audit(db orm.DB, actor Actor, action, target string, before, after interface{}) error {
+	return audit(db, actor, action, target, 0, before, after)
+}
+
+// AuditUser appends an entry about a user. Names may be reused once freed, so the entry also records
+// the user's id.
+func AuditUser(db orm.DB, actor Actor, action string, uid UidT, name string, before, after interface{}) error {
+	return audit(db, actor, action, name, uid, before, after)
+}
+
+func audit(db orm.DB, actor Actor, action, target string, targetUid UidT, before, after interface{}) error {
+	b, err := auditSnapshot(before)
+	if err != nil {
+		return err
+	}
+	a, err := auditSnapshot(after)
+	if err != nil {
+		return err
+	}
+	return db.Insert(&AuditEntry{
+		ActorUid:  actor.Uid,
+		Action:    action,
+		Target:    target,
+		TargetUid: targetUid,
+		Before:    b,
+		After:     a,
+		SourceIp:  actor.Ip,
+		UserAgent: actor.UserAgent,
+		ApiKey:    actor.ApiKey,
+		Time:      time.Now(),
+	})
+}
+
+// Redacted is the user as recorded in the audit log, without the password hash and the TOTP secret.
+// Audit entries outlive the retention period, so the email is masked; the name is the entry's target.
+func (u UserInfo) Redacted() UserInfo {
+	u.Password = ""
+	u.TotpSecret = ""
+	u.Email = MaskedEmail(u.Email)
+	return u
+}
+
+// MaskedEmail keeps the first character of the mailbox and the domain only.
+func MaskedEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return strings.Repeat("*", len(email))
+	}
+	return email[:1] + strings.Repeat("*", at-1) + email[at:]
+}
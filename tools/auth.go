@@ -6,12 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"regexp"
-	"strconv"
+	"sync"
 	"time"
 
-	"github.com/Chips-zhang/DBProjectHust/service"
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
 )
 
 func PasswordSaltedHash(password, salt string) string {
@@ -36,53 +36,189 @@ func CheckPassword(id UidT, password string) error {
 	return nil
 }
 
-var tokenUidMap map[string]UidT
+// After MaxFailedLogins consecutive wrong passwords, an account refuses every password for LockoutDuration.
+var MaxFailedLogins = 5
+var LockoutDuration = 15 * time.Minute
 
-func InitAuthModule() {
-	tokenUidMap = make(map[string]UidT)
-	rand.Seed(time.Now().UnixNano())
+// ErrInvalidCredentials is the only error of a failed password check, so that it tells nothing about the account.
+var ErrInvalidCredentials = errors.New("Invalid username or password, or the account is temporarily locked.")
+
+// passwordMatches compares a supplied password with the stored one. An empty password never matches:
+// users without a password, such as imported ones, cannot log in before choosing one.
+func passwordMatches(stored, supplied string) bool {
+	return stored != "" && supplied != "" && stored == supplied
 }
 
-func GenerateToken() string {
-	timestamp := time.Now().Unix() + rand.Int63()
-	token := fmt.Sprintf("%x", sha256.Sum256([]byte(strconv.FormatInt(timestamp, 10))))[:45]
-	if _, ok := tokenUidMap[token]; ok {
-		return GenerateToken()
-	} else {
-		return token
+// UnusablePassword is a random secret for users who have not chosen a password yet. Nobody knows it
+// until a forgotten password email sends it to the user.
+func UnusablePassword() (string, error) {
+	return randomHex(24)
+}
+
+// checkCredentials verifies the password of a user. Wrong passwords are counted and lock the account.
+func checkCredentials(username, password string) (UserInfo, error) {
+	u := UserInfo{}
+	if !UsernameRegex.MatchString(username) {
+		return u, ErrInvalidCredentials
+	}
+	err := DB_.Model(&u).Where("name = ? AND status <> ?", username, StatusRemoved).Select()
+	if err != nil {
+		if err.Error() == PgNotFoundErr {
+			return u, ErrInvalidCredentials
+		}
+		return u, err
+	}
+
+	if time.Now().Before(u.LockedUntil) {
+		return u, ErrInvalidCredentials
+	}
+	if !passwordMatches(u.Password, password) {
+		recordFailedLogin(u)
+		return u, ErrInvalidCredentials
 	}
+	if u.FailedLogins != 0 {
+		if _, err := DB_.Model(&u).Set("failed_logins = 0").WherePK().Update(); err != nil {
+			return u, err
+		}
+		u.FailedLogins = 0
+	}
+	return u, nil
 }
 
-func DoLogin(username, password string) (string, error) {
-	u, err2 := UsernameToInfo(username)
-	if err2 != nil {
-		return "", err2
+func recordFailedLogin(u UserInfo) {
+	_, err := DB_.Model(&u).Set("failed_logins = failed_logins + 1").WherePK().Returning("failed_logins").Update()
+	if err != nil {
+		log.Print("Unable to record failed login of " + u.Name + ", " + err.Error())
+		return
+	}
+	if u.FailedLogins < MaxFailedLogins {
+		return
 	}
 
-	if u.Password != password {
-		return "", errors.New("Password denied.")
+	_, err = DB_.Model(&u).Set("failed_logins = 0, locked_until = ?", time.Now().Add(LockoutDuration)).WherePK().Update()
+	if err != nil {
+		log.Print("Unable to lock " + u.Name + ", " + err.Error())
+		return
 	}
+	log.Printf("Account %s locked for %s after %d failed logins.", u.Name, LockoutDuration, u.FailedLogins)
+}
 
-	token := GenerateToken()
-	tokenUidMap[token] = u.Id
-	return token, nil
+// UnlockAccount lifts a lockout and forgets the failed logins of a user.
+func UnlockAccount(db orm.DB, uid UidT) error {
+	_, err := db.Model(&UserInfo{Id: uid}).Set("failed_logins = 0, locked_until = NULL").WherePK().Update()
+	return err
 }
 
-func DoLogout(token string) error {
-	if _, ok := tokenUidMap[token]; ok {
-		delete(tokenUidMap, token)
-		return nil
-	} else {
-		return errors.New("Invalid token")
+// LoginStep is the outcome of a correct password: a session token, or a challenge to answer with
+// DoLoginTotp when the user has a second factor.
+type LoginStep struct {
+	Token     string
+	Challenge string
+	// Secret is set when a role of the user requires TOTP but the user has not enrolled yet.
+	// The challenge is then answered with the first code of this new secret.
+	Secret string
+}
+
+// A login challenge lives between the password and the second factor.
+type loginChallenge struct {
+	uid      UidT
+	expires  time.Time
+	attempts int
+}
+
+var LoginChallengeTTL = 5 * time.Minute
+
+const maxChallengeAttempts = 5
+
+var loginChallenges = make(map[string]*loginChallenge)
+var loginChallengesMutex sync.Mutex
+
+// DoLogin checks a password. The client is where the login comes from, recorded in the session.
+func DoLogin(client Actor, username, password string) (LoginStep, error) {
+	u, err := checkCredentials(username, password)
+	if err != nil {
+		return LoginStep{}, err
 	}
+
+	required, err := TotpRequired(u)
+	if err != nil {
+		return LoginStep{}, err
+	}
+	if !u.TotpEnabled && !required {
+		token, err := NewSession(u.Id, client.Ip, client.UserAgent)
+		return LoginStep{Token: token}, err
+	}
+
+	step := LoginStep{}
+	if !u.TotpEnabled {
+		step.Secret, err = GenerateTotpSecret()
+		if err != nil {
+			return step, err
+		}
+		if _, err := DB_.Model(&u).Set("totp_secret = ?", step.Secret).WherePK().Update(); err != nil {
+			return step, err
+		}
+	}
+
+	step.Challenge, err = randomHex(24)
+	if err != nil {
+		return step, err
+	}
+
+	loginChallengesMutex.Lock()
+	defer loginChallengesMutex.Unlock()
+	now := time.Now()
+	for id, c := range loginChallenges {
+		if now.After(c.expires) {
+			delete(loginChallenges, id)
+		}
+	}
+	loginChallenges[step.Challenge] = &loginChallenge{uid: u.Id, expires: now.Add(LoginChallengeTTL)}
+	return step, nil
 }
 
-func VerifyToken(token string) (UidT, error) {
-	if val, ok := tokenUidMap[token]; ok {
-		return val, nil
+// DoLoginTotp answers a login challenge with a TOTP code or a recovery code. For a user enrolling
+// during the login, it also enables TOTP and returns the new recovery codes.
+func DoLoginTotp(client Actor, challenge, code string) (string, []string, error) {
+	loginChallengesMutex.Lock()
+	c, ok := loginChallenges[challenge]
+	if ok && (time.Now().After(c.expires) || c.attempts >= maxChallengeAttempts) {
+		delete(loginChallenges, challenge)
+		ok = false
+	}
+	if ok {
+		c.attempts++
+	}
+	loginChallengesMutex.Unlock()
+	if !ok {
+		return "", nil, errors.New("The login expired. Enter your password again.")
+	}
+
+	u := UserInfo{Id: c.uid}
+	if err := DB_.Select(&u); err != nil {
+		return "", nil, err
+	}
+
+	var recoveryCodes []string
+	if u.TotpEnabled {
+		if !CheckSecondFactor(DB_, u, code) {
+			recordFailedLogin(u)
+			return "", nil, errors.New("Invalid code.")
+		}
 	} else {
-		return -1, errors.New("Invalid token")
+		var err error
+		recoveryCodes, err = EnableTotp(u, code)
+		if err != nil {
+			return "", nil, err
+		}
 	}
+
+	loginChallengesMutex.Lock()
+	delete(loginChallenges, challenge)
+	loginChallengesMutex.Unlock()
+
+	token, err := NewSession(u.Id, client.Ip, client.UserAgent)
+	return token, recoveryCodes, err
 }
 
 var domainRegex = regexp.MustCompile("^[a-zA-Z0-9:./_-]*$")
@@ -92,43 +228,52 @@ func ForgetPassword(email, domain, proto string) error {
 	if !UsernameRegex.MatchString(email) {
 		return errors.New("Invalid email format.")
 	}
-	err := DB_.Model(&u).Where("email = '" + email + "'").Select()
+	if !domainRegex.MatchString(domain) {
+		return errors.New("Invalid domain format.")
+	}
+
+	err := DB_.Model(&u).Where("email = ? AND status <> ?", email, StatusRemoved).Select()
 	if err != nil {
 		if err.Error() == PgNotFoundErr {
-			return errors.New("Email not found.")
+			// Answer as if the email was sent, so that nobody learns which emails are registered.
+			return nil
 		}
 		return err
 	}
 
-	if !domainRegex.MatchString(domain) {
-		return errors.New("Invalid domain format.")
+	link := fmt.Sprintf("%s//%s/changePassword.html?old=%s&name=%s", proto, domain, u.Password, u.Name)
+	e, err := RenderEmail("password_reset", u.Language, u.Email, map[string]interface{}{"Name": u.Name, "Link": link})
+	if err != nil {
+		return err
 	}
-
-	emailTxt := fmt.Sprintf("Your username is %s. Use the following link to reset your password:\n %s//%s/changePassword.html?old=%s&name=%s\n\nTMobile",
-		u.Name, proto, domain, u.Password, u.Name)
-	go func() {
-		err := service.SendEmail(email, "TMobile password reset", emailTxt)
-		if err == nil {
-			log.Print("Sent email to " + email)
-		} else {
-			log.Print("Unable to send email to " + email + ", " + err.Error())
-		}
-	}()
-
-	return nil
+	// The link holds the password: the outbox must not keep it.
+	e.Secret = true
+	return EnqueueEmail(DB_, e)
 }
 
-func ChangePassword(name, old, new string) error {
-	u, err := UsernameToInfo(name)
+// ChangePassword is authenticated by the old password, so the user is recorded as the actor.
+// Every session of the user ends: whoever knew the old password is logged out.
+func ChangePassword(actor Actor, name, old, new string) error {
+	if new == "" {
+		return errors.New("The new password must not be empty.")
+	}
+	// The old password is checked like a login, so that this cannot be used to guess it either.
+	u, err := checkCredentials(name, old)
 	if err != nil {
 		return err
 	}
-
-	if u.Password != old {
-		return errors.New("Invalid old password.")
-	}
 	u.Password = new
+	actor.Uid = u.Id
 
-	err2 := DB_.Update(&u)
-	return err2
+	err = DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tx.Update(&u); err != nil {
+			return err
+		}
+		return Audit(tx, actor, "ChangePassword", u.Name, nil, nil)
+	})
+	if err != nil {
+		return err
+	}
+	RevokeUserSessions(u.Id)
+	return nil
 }
@@ -0,0 +1,50 @@
+package tools
+
+import (
+	"fmt"
+	"time"
+)
+
+// States of a BalanceBatch. A draft is applied in chunks, and an applied batch may be reversed as a
+// whole. A running or reversing batch that stopped on an error keeps its state and the error, and
+// resumes from where it stopped.
+const (
+	BatchDraft     = "draft"
+	BatchRunning   = "running"
+	BatchDone      = "done"
+	BatchReversing = "reversing"
+	BatchReversed  = "reversed"
+	BatchDiscarded = "discarded"
+)
+
+type BatchidT int64
+
+// BalanceBatch adjusts the balances of many customers at once. Its items are frozen at creation, so
+// that what is applied is what was previewed. Every ledger entry it writes carries its id.
+type BalanceBatch struct {
+	Id          BatchidT `sql:",pk,unique"`
+	Note        string   `sql:",notnull"`
+	Selector    string   // how the accounts were chosen, as the API arguments
+	State       string   `sql:",notnull"`
+	Accounts    int      `sql:",notnull"`
+	TotalAmount MoneyT   `sql:",notnull"`
+	Done        int      `sql:",notnull,default:0"` // items applied, or reversed while reversing
+	Error       string   // why the batch stopped
+	CreatedBy   UidT
+	CreatedAt   time.Time
+	AppliedAt   time.Time
+	ReversedAt  time.Time
+}
+
+func (b BalanceBatch) String() string {
+	return fmt.Sprintf("BalanceBatch<%d %s %d %s>", b.Id, b.State, b.Accounts, b.TotalAmount.String())
+}
+
+// BalanceBatchItem is the adjustment of one account by a batch.
+type BalanceBatchItem struct {
+	BatchId  BatchidT `sql:",pk"`
+	UId      UidT     `sql:",pk"`
+	Amount   MoneyT   `sql:",notnull"`
+	Applied  bool     `sql:",notnull,default:false"`
+	Reversed bool     `sql:",notnull,default:false"`
+}
@@ -0,0 +1,58 @@
+package tools
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	AccountPrepaid  = "prepaid"
+	AccountPostpaid = "postpaid"
+
+	StatusActive      = "active"
+	StatusSuspended   = "suspended"
+	StatusCollections = "collections"
+	StatusRemoved     = "removed" // archived by RemoveUser, kept for the ledger
+
+	InvoiceOpen = "open"
+	InvoicePaid = "paid"
+)
+
+const BillingPeriodLayout = "2006-01"
+
+type InvoiceidT int64
+
+// Invoice is issued to every customer with a plan at the end of each billing period.
+// AmountDue is what the customer still owes once the charges hit the balance.
+type Invoice struct {
+	Id        InvoiceidT `sql:",pk,unique"`
+	UId       UidT       `sql:",unique:invoice_period"`
+	Period    string     `sql:",unique:invoice_period"`
+	Amount    MoneyT
+	AmountDue MoneyT
+	State     string `sql:",notnull"`
+	IssuedAt  time.Time
+	DueAt     time.Time
+	PaidAt    time.Time
+	// The balance batch whose credit paid the invoice, and what was due then, so that reversing the
+	// batch reopens it.
+	SettledByBatch BatchidT
+	SettledDue     MoneyT
+}
+
+func (i Invoice) String() string {
+	return fmt.Sprintf("Invoice<%d %d %s %d %s>", i.Id, i.UId, i.Period, i.Amount, i.State)
+}
+
+type InvoiceLine struct {
+	Id          int64 `sql:",pk,unique"`
+	InvoiceId   InvoiceidT
+	Description string
+	Amount      MoneyT
+}
+
+// BillingCycle marks a period as completely billed.
+type BillingCycle struct {
+	Period string `sql:",pk"`
+	RanAt  time.Time
+}
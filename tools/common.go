@@ -6,16 +6,42 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
 )
 
+// Permissions are granted to users through their roles, see RoleGrant.
 const (
-	PermAdmin        = "root"
-	PermCashier      = "cashier"
-	PermCustomerServ = "customer_service"
-	PermCustomer     = "customer"
-	PermPublic       = "public"
+	PermCustomer            = "customer" // the user is a subscriber, with a line, a plan and a balance
+	PermUserView            = "user.view"
+	PermUserManageCustomers = "user.manage_customers"
+	PermUserManageStaff     = "user.manage_staff"
+	PermUserImpersonate     = "user.impersonate"
+	PermProfileView         = "profile.view"   // the full KYC profile, others see a masked summary
+	PermProfileManage       = "profile.manage" // change the identity of a customer
+	PermDataExport          = "data.export"    // export everything held about a customer
+	PermBalanceView         = "balance.view"
+	PermBalanceTopup        = "balance.topup"
+	PermBalanceBatch        = "balance.batch" // adjust many balances at once, capped per account
+	PermPromotionManage     = "promotion.manage"
+	PermPromotionRedeem     = "promotion.redeem" // apply a discount code to a customer's account
+	PermPlanView            = "plan.view"
+	PermPlanManage          = "plan.manage"
+	PermPlanAssign          = "plan.assign"
+	PermNumberManage        = "number.manage"
+	PermNumberAssign        = "number.assign"
+	PermSimManage           = "sim.manage"
+	PermAccountManage       = "account.manage"
+	PermCreditManage        = "credit.manage"
+	PermBillingRun          = "billing.run"
+	PermNotificationManage  = "notification.manage"
+	PermOutboxManage        = "outbox.manage"
+	PermAuditView           = "audit.view"
+	PermRoleManage          = "role.manage"
+	PermApiKeyManage        = "apikey.manage"
+	PermDatabaseReset       = "database.reset"
 
 	RoleAdmin          = "root"
 	ROLE_CASHIER       = "cashier"
@@ -27,20 +53,10 @@ const PasswordSalt = "rsalt"
 const RootUid = 1
 const PgNotFoundErr = "pg: no rows in result set"
 const EarningPerAdduser = 1000 // Earn 10 dollar for every new customer
-var RolesPermission map[string][]string
 
 var MoneyStrRegex = regexp.MustCompile(`^[0-9]+\.[0-9][0-9]$`)
 var UsernameRegex = regexp.MustCompile(`^[A-Za-z0-9_, @.:;-]*$`)
 
-func InitCommon() {
-	RolesPermission = map[string][]string{
-		"root":     {PermAdmin, PermCashier, PermCustomerServ, PermCustomer, PermPublic},
-		"cash":     {PermCashier, PermPublic},
-		"serv":     {PermCustomerServ, PermPublic},
-		"customer": {PermCustomer, PermPublic},
-	}
-}
-
 // common data structure
 
 type UidT int64
@@ -85,25 +101,55 @@ func StringToMoneyT(s string) (MoneyT, error) {
 	}
 }
 
+// Set parses a money flag such as `-late-fee 5.00`.
+func (m *MoneyT) Set(s string) error {
+	v, err := StringToMoneyT(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
 type UserInfo struct {
 	Id           UidT   `sql:",pk,unique"`
 	Name         string `sql:",unique"`
 	Password     string
-	Permissions  []string `sql:",array"`
+	Roles        []string `sql:",array"`
 	Balance      MoneyT   // `10.32` is saved as `1032`
 	Achievements MoneyT
 	Plan         PlanidT `sql:",notnull"`
 	Email        string  `sql:",unique"`
+	AccountType  string  `sql:",notnull,default:'prepaid'"`
+	CreditLimit  MoneyT  `sql:",notnull,default:0"` // how far below zero a postpaid balance may go
+	Status       string  `sql:",notnull,default:'active'"`
+	Language     string  `sql:",notnull,default:'en'"` // language of emails, one of SupportedLanguages
+	FailedLogins int     `sql:",notnull,default:0"`    // consecutive wrong passwords, see MaxFailedLogins
+	LockedUntil  time.Time
+	TotpSecret   string // base32, pending until TotpEnabled
+	TotpEnabled  bool   `sql:",notnull,default:false"`
+	TotpLastStep int64  `sql:",notnull,default:0"` // the last accepted TOTP time step, so that codes cannot be replayed
+	RemovedAt    time.Time
+	AnonymizedAt time.Time // when the retention job erased the personal data of a removed user
 }
 
 func (u UserInfo) String() string {
-	return fmt.Sprintf("UserInfo<%d %s %s BAL=%d ACHI=%d>", u.Id, u.Name, strings.Join(u.Permissions, ","), u.Balance, u.Achievements)
+	return fmt.Sprintf("UserInfo<%d %s %s BAL=%d ACHI=%d %s>", u.Id, u.Name, strings.Join(u.Roles, ","), u.Balance, u.Achievements, u.Status)
+}
+
+// BalanceFloor is the lowest balance the user may reach before being suspended.
+func (u UserInfo) BalanceFloor() MoneyT {
+	if u.AccountType == AccountPostpaid {
+		return -u.CreditLimit
+	}
+	return 0
 }
 
 type UserBalanceEvent struct {
 	EventId UidT `sql:",pk,unique"`
 	UId     UidT
-	What    string // should not contain `;`
+	What    string   // should not contain `;`
+	BatchId BatchidT // the BalanceBatch that wrote the entry, if any
 }
 
 func (u UserBalanceEvent) String() string {
@@ -124,6 +170,79 @@ func (p PlanInfo) String() string {
 
 var DB_ *pg.DB
 
+// TableModels lists every model backed by a table, in creation order.
+func TableModels() []interface{} {
+	return []interface{}{&UserInfo{}, &UserBalanceEvent{}, &PlanInfo{}, &PhoneNumber{}, &SimCard{},
+		&Invoice{}, &InvoiceLine{}, &BillingCycle{}, &DunningStep{},
+		&NotificationSettings{}, &Notification{}, &OutboxEmail{}, &AuditEntry{}, &Role{}, &RoleGrant{}, &RecoveryCode{},
+		&ApiKey{}, &CustomerProfile{}, &BalanceBatch{}, &BalanceBatchItem{},
+		&Promotion{}, &PromotionRedemption{}}
+}
+
+// Migrations bring tables created by older versions up to date. Every statement must be idempotent.
+var Migrations = []string{
+	`ALTER TABLE user_infos ADD COLUMN IF NOT EXISTS account_type text NOT NULL DEFAULT 'prepaid'`,
+	`ALTER TABLE user_infos ADD COLUMN IF NOT EXISTS credit_limit bigint NOT NULL DEFAULT 0`,
+	`ALTER TABLE user_infos ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'active'`,
+	`ALTER TABLE user_infos ADD COLUMN IF NOT EXISTS language text NOT NULL DEFAULT 'en'`,
+	`ALTER TABLE outbox_emails ADD COLUMN IF NOT EXISTS html text`,
+	`ALTER TABLE outbox_emails ADD COLUMN IF NOT EXISTS secret boolean NOT NULL DEFAULT FALSE`,
+	// Password reset emails used to be kept with the password in their link.
+	`UPDATE outbox_emails SET body = '', html = '', secret = TRUE
+		WHERE state <> 'pending' AND body LIKE '%changePassword.html?old=%'`,
+	`CREATE OR REPLACE RULE audit_entries_no_update AS ON UPDATE TO audit_entries DO INSTEAD NOTHING`,
+	`CREATE OR REPLACE RULE audit_entries_no_delete AS ON DELETE TO audit_entries DO INSTEAD NOTHING`,
+	// Users used to carry raw permission lists. Give each of them the built-in role matching its list.
+	`ALTER TABLE user_infos ADD COLUMN IF NOT EXISTS roles text[]`,
+	`DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'user_infos' AND column_name = 'permissions') THEN
+			UPDATE user_infos SET roles = CASE
+				WHEN 'root' = ANY(permissions) THEN ARRAY['root']
+				ELSE ARRAY(SELECT unnest(permissions) INTERSECT SELECT unnest(ARRAY['cashier', 'customer_service', 'customer']))
+			END WHERE roles IS NULL;
+			ALTER TABLE user_infos DROP COLUMN permissions;
+		END IF;
+	END $$`,
+	`ALTER TABLE user_infos ADD COLUMN IF NOT EXISTS failed_logins bigint NOT NULL DEFAULT 0`,
+	`ALTER TABLE user_infos ADD COLUMN IF NOT EXISTS locked_until timestamptz`,
+	`ALTER TABLE user_infos ADD COLUMN IF NOT EXISTS totp_secret text`,
+	`ALTER TABLE user_infos ADD COLUMN IF NOT EXISTS totp_enabled boolean NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE user_infos ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0`,
+	`ALTER TABLE user_infos ADD COLUMN IF NOT EXISTS removed_at timestamptz`,
+	`ALTER TABLE user_infos ADD COLUMN IF NOT EXISTS anonymized_at timestamptz`,
+	`CREATE INDEX IF NOT EXISTS user_infos_removed_idx ON user_infos (removed_at) WHERE status = 'removed'`,
+	`ALTER TABLE roles ADD COLUMN IF NOT EXISTS require_totp boolean NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE audit_entries ADD COLUMN IF NOT EXISTS api_key text`,
+	`ALTER TABLE audit_entries ADD COLUMN IF NOT EXISTS target_uid bigint`,
+	`CREATE INDEX IF NOT EXISTS audit_entries_target_uid_idx ON audit_entries (target_uid) WHERE target_uid IS NOT NULL`,
+	// Indexes of the filters and sort keys of the list APIs.
+	`CREATE INDEX IF NOT EXISTS user_infos_balance_idx ON user_infos (balance, id)`,
+	`CREATE INDEX IF NOT EXISTS user_infos_plan_idx ON user_infos (plan)`,
+	`CREATE INDEX IF NOT EXISTS user_infos_roles_idx ON user_infos USING gin (roles)`,
+	`CREATE INDEX IF NOT EXISTS user_balance_events_u_id_idx ON user_balance_events (u_id, event_id)`,
+	`ALTER TABLE user_balance_events ADD COLUMN IF NOT EXISTS batch_id bigint`,
+	`CREATE INDEX IF NOT EXISTS user_balance_events_batch_id_idx ON user_balance_events (batch_id) WHERE batch_id IS NOT NULL`,
+	`ALTER TABLE invoices ADD COLUMN IF NOT EXISTS settled_by_batch bigint`,
+	`ALTER TABLE invoices ADD COLUMN IF NOT EXISTS settled_due bigint`,
+	`CREATE INDEX IF NOT EXISTS promotion_redemptions_u_id_idx ON promotion_redemptions (u_id)`,
+	// Trigram indexes of the user search, for similarity and for LIKE patterns.
+	`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+	`CREATE INDEX IF NOT EXISTS user_infos_name_trgm_idx ON user_infos USING gin (name gin_trgm_ops)`,
+	`CREATE INDEX IF NOT EXISTS user_infos_email_trgm_idx ON user_infos USING gin (email gin_trgm_ops)`,
+	`CREATE INDEX IF NOT EXISTS phone_numbers_number_trgm_idx ON phone_numbers USING gin (number gin_trgm_ops)`,
+	`CREATE INDEX IF NOT EXISTS customer_profiles_id_number_trgm_idx ON customer_profiles USING gin (id_number gin_trgm_ops)`,
+}
+
+// Migrate runs the Migrations, after the tables are created.
+func Migrate(db orm.DB) error {
+	for _, migration := range Migrations {
+		if _, err := db.Exec(migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // other common functions
 func ArrayContains(arr []string, item string) bool {
 	for _, ele := range arr {
@@ -135,26 +254,26 @@ func ArrayContains(arr []string, item string) bool {
 }
 
 func CheckPermission(commiter UidT, perm string) bool {
-	commiterInfo := UserInfo{
-		Id: commiter,
-	}
-	err := DB_.Select(&commiterInfo)
+	grants, err := UserGrants(commiter)
 	if err != nil {
 		return false
 	}
+	return grants.Has(perm)
+}
 
-	if !ArrayContains(commiterInfo.Permissions, perm) {
-		return false
-	}
-	return true
+// ArchivedName replaces the name of a removed user once it is freed for reuse. UsernameRegex rejects
+// it, so that it never clashes with the name of a new user.
+func ArchivedName(uid UidT) string {
+	return fmt.Sprintf("~removed-%d", uid)
 }
 
+// UsernameToInfo finds a user by name. Removed users are not found.
 func UsernameToInfo(name string) (UserInfo, error) {
 	if !UsernameRegex.MatchString(name) {
 		return UserInfo{}, errors.New("Invalid username format.")
 	}
 	u := UserInfo{}
-	err := DB_.Model(&u).Where(fmt.Sprintf("name = '%s'", name)).Select()
+	err := DB_.Model(&u).Where(fmt.Sprintf("name = '%s'", name)).Where("status <> ?", StatusRemoved).Select()
 	if err != nil && err.Error() == PgNotFoundErr {
 		return u, errors.New("Name not found: " + name)
 	}
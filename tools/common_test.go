@@ -38,3 +38,23 @@ func TestMoney(t *testing.T) {
 		}
 	}
 }
+
+func TestArchivedName(t *testing.T) {
+	name := ArchivedName(42)
+	if name != "~removed-42" || UsernameRegex.MatchString(name) {
+		t.Errorf("ArchivedName(42) = %q must not be a valid username", name)
+	}
+}
+
+func TestPasswordMatches(t *testing.T) {
+	imported, err := UnusablePassword()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passwordMatches(imported, "") || passwordMatches("", "") {
+		t.Error("an empty password logged in")
+	}
+	if !passwordMatches(imported, imported) || passwordMatches("secret", "Secret") {
+		t.Error("password comparison")
+	}
+}
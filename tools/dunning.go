@@ -0,0 +1,29 @@
+package tools
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DunningReminder    = "reminder"
+	DunningLateFee     = "late_fee"
+	DunningSuspension  = "suspension"
+	DunningCollections = "collections"
+)
+
+// DunningStep records one action taken on an overdue invoice, so that it is taken only once.
+type DunningStep struct {
+	Id          int64      `sql:",pk,unique"`
+	UId         UidT       `sql:",notnull"`
+	InvoiceId   InvoiceidT `sql:",unique:dunning_step"`
+	Step        string     `sql:",unique:dunning_step"`
+	Offset      int        `sql:",notnull,unique:dunning_step"` // days after the due date
+	DaysOverdue int
+	Time        time.Time
+	Note        string
+}
+
+func (d DunningStep) String() string {
+	return fmt.Sprintf("DunningStep<%d %d %s@%d>", d.UId, d.InvoiceId, d.Step, d.Offset)
+}
@@ -0,0 +1,207 @@
+package tools
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Email is one outgoing message. HTML is an optional alternative to the plain text Body. Secret marks a
+// message carrying a credential, which the outbox does not keep once it is done with it.
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+	HTML    string
+	Secret  bool
+}
+
+// Bytes renders the message in RFC 5322 format.
+func (e Email) Bytes(from string) []byte {
+	headers := [][2]string{
+		{"From", (&mail.Address{Address: from}).String()},
+		{"To", (&mail.Address{Address: e.To}).String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", e.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+	}
+
+	var body bytes.Buffer
+	if e.HTML == "" {
+		headers = append(headers, [2]string{"Content-Type", "text/plain; charset=utf-8"})
+		body.WriteString(e.Body)
+	} else {
+		w := multipart.NewWriter(&body)
+		headers = append(headers, [2]string{"Content-Type", "multipart/alternative; boundary=" + w.Boundary()})
+		for _, part := range [][2]string{{"text/plain", e.Body}, {"text/html", e.HTML}} {
+			pw, _ := w.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {part[0] + "; charset=utf-8"},
+				"Content-Transfer-Encoding": {"quoted-printable"},
+			})
+			qw := quotedprintable.NewWriter(pw)
+			_, _ = qw.Write([]byte(part[1]))
+			_ = qw.Close()
+		}
+		_ = w.Close()
+	}
+
+	message := ""
+	for _, h := range headers {
+		message += fmt.Sprintf("%s: %s\r\n", h[0], h[1])
+	}
+	message += "\r\n" + body.String()
+	return []byte(message)
+}
+
+// Mailer delivers emails.
+type Mailer interface {
+	Send(e Email) error
+}
+
+const (
+	TLSModeStartTLS = "starttls"
+	TLSModeImplicit = "tls"
+	TLSModeNone     = "none"
+)
+
+// SMTPMailer delivers through an SMTP server. The server certificate is always verified.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	TLSMode  string // one of TLSModeStartTLS, TLSModeImplicit or TLSModeNone
+}
+
+func (m *SMTPMailer) Send(e Email) error {
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	tlsconfig := &tls.Config{ServerName: m.Host}
+
+	var c *smtp.Client
+	var err error
+	switch m.TLSMode {
+	case TLSModeImplicit:
+		conn, err := tls.Dial("tcp", addr, tlsconfig)
+		if err != nil {
+			return err
+		}
+		c, err = smtp.NewClient(conn, m.Host)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	case TLSModeStartTLS, TLSModeNone:
+		c, err = smtp.Dial(addr)
+		if err != nil {
+			return err
+		}
+		if m.TLSMode == TLSModeStartTLS {
+			if err = c.StartTLS(tlsconfig); err != nil {
+				c.Close()
+				return err
+			}
+		}
+	default:
+		return errors.New("Unknown SMTP TLS mode: " + m.TLSMode)
+	}
+	defer c.Close()
+
+	// Auth
+	if m.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+
+	// To && From
+	if err = c.Mail(m.From); err != nil {
+		return err
+	}
+
+	if err = c.Rcpt(e.To); err != nil {
+		return err
+	}
+
+	// Data
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(e.Bytes(m.From))
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// FileMailer writes every email as an .eml file into Dir instead of sending it.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(e Email) error {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), e.Bytes(m.From), 0644)
+}
+
+// MemoryMailer keeps every email in memory, without bound. It is meant for tests only.
+type MemoryMailer struct {
+	mutex sync.Mutex
+	sent  []Email
+}
+
+func (m *MemoryMailer) Send(e Email) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sent = append(m.sent, e)
+	return nil
+}
+
+// Sent returns a copy of the emails sent so far.
+func (m *MemoryMailer) Sent() []Email {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Email(nil), m.sent...)
+}
+
+// DiscardMailer drops every email.
+type DiscardMailer struct{}
+
+func (DiscardMailer) Send(e Email) error {
+	return nil
+}
+
+// DefaultMailer is used by SendEmail. main replaces it according to the command line.
+var DefaultMailer Mailer = DiscardMailer{}
+
+func SendEmail(toAddress, subj, body string) error {
+	return DefaultMailer.Send(Email{To: toAddress, Subject: subj, Body: body})
+}
@@ -0,0 +1,46 @@
+package tools
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMailing(t *testing.T) {
+	mailer := &MemoryMailer{}
+	DefaultMailer = mailer
+	err := SendEmail("root@recolic.net", "testing", "content\nhello")
+	if err != nil {
+		t.Error(err.Error())
+	}
+	sent := mailer.Sent()
+	if len(sent) != 1 || sent[0].To != "root@recolic.net" || sent[0].Body != "content\nhello" {
+		t.Error("memory mailer boom")
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mails")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	mailer := &FileMailer{Dir: dir, From: "no-reply@recolic.net"}
+	err = mailer.Send(Email{To: "root@recolic.net", Subject: "重置密码", Body: "content\nhello"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || !strings.HasSuffix(files[0].Name(), ".eml") {
+		t.Fatal("file mailer wrote no .eml file")
+	}
+	content, _ := ioutil.ReadFile(dir + "/" + files[0].Name())
+	for _, expected := range []string{"To: <root@recolic.net>\r\n", "Subject: =?utf-8?q?", "\r\n\r\ncontent\nhello"} {
+		if !strings.Contains(string(content), expected) {
+			t.Error("eml file lacks " + expected)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package tools
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	NotifyLowBalance      = "low_balance"
+	NotifyPaymentReceived = "payment_received"
+	NotifyPlanChanged     = "plan_changed"
+)
+
+var NotificationTypes = []string{NotifyLowBalance, NotifyPaymentReceived, NotifyPlanChanged}
+
+// NotificationSettings holds a customer's preferences. Customers without a row get the defaults.
+type NotificationSettings struct {
+	UId                 UidT `sql:",pk"`
+	LowBalanceThreshold MoneyT
+	OptOut              []string `sql:",array"` // notification types the customer does not want
+}
+
+// Notification is one delivery attempt on one channel.
+type Notification struct {
+	Id      int64 `sql:",pk,unique"`
+	UId     UidT
+	Type    string
+	Channel string
+	Subject string
+	Body    string
+	Time    time.Time
+	Error   string
+}
+
+func (n Notification) String() string {
+	return fmt.Sprintf("Notification<%d %s %s>", n.UId, n.Type, n.Channel)
+}
@@ -0,0 +1,30 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const (
+	NumberAvailable   = "available"
+	NumberReserved    = "reserved"
+	NumberAssigned    = "assigned"
+	NumberQuarantined = "quarantined"
+)
+
+var PhoneNumberRegex = regexp.MustCompile(`^[0-9]{5,15}$`)
+
+// PhoneNumber is one MSISDN in the carrier's number inventory.
+type PhoneNumber struct {
+	Number          string `sql:",pk"`
+	State           string `sql:",notnull"`
+	UId             UidT   // owner while assigned
+	ReservedBy      UidT   // operator holding the reservation
+	ReservedUntil   time.Time
+	QuarantineUntil time.Time
+}
+
+func (n PhoneNumber) String() string {
+	return fmt.Sprintf("PhoneNumber<%s %s %d>", n.Number, n.State, n.UId)
+}
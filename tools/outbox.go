@@ -0,0 +1,125 @@
+package tools
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+)
+
+// OutboxEmail is an email waiting for, or done with, delivery by the outbox worker.
+type OutboxEmail struct {
+	Id            int64 `sql:",pk,unique"`
+	To            string
+	Subject       string
+	Body          string
+	Html          string
+	Secret        bool   `sql:",notnull,default:false"` // the body is dropped once sent or given up
+	State         string `sql:",notnull"`
+	Attempts      int    `sql:",notnull,default:0"`
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+	SentAt        time.Time
+}
+
+func (e OutboxEmail) String() string {
+	return fmt.Sprintf("OutboxEmail<%d %s %s %d>", e.Id, e.To, e.State, e.Attempts)
+}
+
+var OutboxMaxAttempts = 8
+var OutboxBaseDelay = 30 * time.Second
+var OutboxMaxDelay = 6 * time.Hour
+var OutboxPollInterval = 5 * time.Second
+
+// EnqueueEmail queues an email for delivery. Pass the transaction of the business change, so that the
+// email is sent if and only if the change is committed.
+func EnqueueEmail(db orm.DB, e Email) error {
+	now := time.Now()
+	return db.Insert(&OutboxEmail{
+		To:            e.To,
+		Subject:       e.Subject,
+		Body:          e.Body,
+		Html:          e.HTML,
+		Secret:        e.Secret,
+		State:         OutboxPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+}
+
+// outboxBackoff is the delay before the next attempt after the given number of failed attempts.
+func outboxBackoff(attempts int) time.Duration {
+	delay := OutboxBaseDelay
+	for i := 1; i < attempts && delay < OutboxMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > OutboxMaxDelay {
+		delay = OutboxMaxDelay
+	}
+	return delay
+}
+
+// finish drops the content of a secret email once it is no longer going to be sent.
+func (e *OutboxEmail) finish() {
+	if e.Secret && e.State != OutboxPending {
+		e.Body = ""
+		e.Html = ""
+	}
+}
+
+// deliverNextEmail sends one due email. It returns false if nothing was due.
+func deliverNextEmail() (bool, error) {
+	delivered := false
+	err := DB_.RunInTransaction(func(tx *pg.Tx) error {
+		e := OutboxEmail{}
+		err := tx.Model(&e).Where("state = ? AND next_attempt_at <= ?", OutboxPending, time.Now()).
+			Order("next_attempt_at").Limit(1).For("UPDATE SKIP LOCKED").Select()
+		if err != nil {
+			if err.Error() == PgNotFoundErr {
+				return nil
+			}
+			return err
+		}
+		delivered = true
+
+		e.Attempts++
+		err = DefaultMailer.Send(Email{To: e.To, Subject: e.Subject, Body: e.Body, HTML: e.Html})
+		if err == nil {
+			e.State = OutboxSent
+			e.SentAt = time.Now()
+			e.LastError = ""
+		} else if e.Attempts >= OutboxMaxAttempts {
+			e.State = OutboxFailed
+			e.LastError = err.Error()
+			log.Printf("Giving up email %d to %s after %d attempts, %s", e.Id, e.To, e.Attempts, err.Error())
+		} else {
+			e.NextAttemptAt = time.Now().Add(outboxBackoff(e.Attempts))
+			e.LastError = err.Error()
+		}
+		e.finish()
+		return tx.Update(&e)
+	})
+	return delivered, err
+}
+
+// RunOutboxWorker delivers queued emails. It never returns.
+func RunOutboxWorker() {
+	for {
+		delivered, err := deliverNextEmail()
+		if err != nil {
+			log.Print("Outbox delivery failed. " + err.Error())
+		}
+		if !delivered || err != nil {
+			time.Sleep(OutboxPollInterval)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	expected := map[int]time.Duration{
+		1:  OutboxBaseDelay,
+		2:  2 * OutboxBaseDelay,
+		4:  8 * OutboxBaseDelay,
+		30: OutboxMaxDelay,
+	}
+	for attempts, delay := range expected {
+		if outboxBackoff(attempts) != delay {
+			t.Errorf("backoff boom: %d -- %s", attempts, outboxBackoff(attempts))
+		}
+	}
+}
+
+func TestOutboxEmailFinish(t *testing.T) {
+	e := OutboxEmail{Body: "password", Html: "password", Secret: true, State: OutboxPending}
+	e.finish()
+	if e.Body == "" {
+		t.Error("dropped a pending email")
+	}
+	for _, state := range []string{OutboxSent, OutboxFailed} {
+		e := OutboxEmail{Body: "password", Html: "password", Secret: true, State: state}
+		e.finish()
+		if e.Body != "" || e.Html != "" {
+			t.Errorf("%s: kept the secret", state)
+		}
+	}
+	e = OutboxEmail{Body: "hello", State: OutboxSent}
+	e.finish()
+	if e.Body != "hello" {
+		t.Error("dropped an ordinary email")
+	}
+}
@@ -0,0 +1,190 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ID document types accepted by CustomerProfile.IdType.
+const (
+	IdPassport        = "passport"
+	IdNationalId      = "national_id"
+	IdDriverLicense   = "driver_license"
+	IdResidencePermit = "residence_permit"
+)
+
+var IdTypes = []string{IdPassport, IdNationalId, IdDriverLicense, IdResidencePermit}
+
+// MinCustomerAge is the age a customer must have reached to hold a line.
+var MinCustomerAge = 16
+
+var idNumberRegex = regexp.MustCompile(`^[A-Za-z0-9-]{4,32}$`)
+var postalCodeRegex = regexp.MustCompile(`^[A-Za-z0-9 -]{3,10}$`)
+var countryRegex = regexp.MustCompile(`^[A-Z]{2}$`)
+var phoneRegex = regexp.MustCompile(`^\+?[0-9 ()-]{6,20}$`)
+
+// CustomerProfile holds the know-your-customer data of a user. The preferred language is
+// UserInfo.Language, which emails use too.
+type CustomerProfile struct {
+	UId         UidT   `sql:",pk"`
+	LegalName   string `sql:",notnull"`
+	IdType      string `sql:",notnull"`
+	IdNumber    string `sql:",notnull"`
+	DateOfBirth time.Time
+	Address     string `sql:",notnull"`
+	City        string `sql:",notnull"`
+	PostalCode  string `sql:",notnull"`
+	Country     string `sql:",notnull"` // ISO 3166-1 alpha-2
+	AltPhone    string `sql:",notnull"`
+	AltEmail    string `sql:",notnull"`
+	UpdatedAt   time.Time
+}
+
+func (p CustomerProfile) String() string {
+	return fmt.Sprintf("CustomerProfile<%d %s>", p.UId, p.LegalName)
+}
+
+// ProfileFields are the fields of a profile, as named by the API.
+var ProfileFields = []string{"legal_name", "id_type", "id_number", "date_of_birth", "address", "city",
+	"postal_code", "country", "alt_phone", "alt_email"}
+
+// IdentityFields identify the customer. Once set, only staff may change them.
+var IdentityFields = []string{"legal_name", "id_type", "id_number", "date_of_birth"}
+
+func checkText(field, value string, max int) error {
+	if utf8.RuneCountInString(value) > max {
+		return fmt.Errorf("The %s is longer than %d characters.", field, max)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return errors.New("The " + field + " must be a single line.")
+	}
+	return nil
+}
+
+// Get returns a field as the API shows it.
+func (p CustomerProfile) Get(field string) string {
+	switch field {
+	case "legal_name":
+		return p.LegalName
+	case "id_type":
+		return p.IdType
+	case "id_number":
+		return p.IdNumber
+	case "date_of_birth":
+		if p.DateOfBirth.IsZero() {
+			return ""
+		}
+		return p.DateOfBirth.Format("2006-01-02")
+	case "address":
+		return p.Address
+	case "city":
+		return p.City
+	case "postal_code":
+		return p.PostalCode
+	case "country":
+		return p.Country
+	case "alt_phone":
+		return p.AltPhone
+	case "alt_email":
+		return p.AltEmail
+	}
+	return ""
+}
+
+// Set validates and changes a field. An empty value clears it.
+func (p *CustomerProfile) Set(field, value string) error {
+	value = strings.TrimSpace(value)
+	switch field {
+	case "legal_name":
+		if err := checkText("legal name", value, 100); err != nil {
+			return err
+		}
+		p.LegalName = value
+	case "id_type":
+		if value != "" && !ArrayContains(IdTypes, value) {
+			return errors.New("Unknown ID type. Use one of " + strings.Join(IdTypes, ","))
+		}
+		p.IdType = value
+	case "id_number":
+		if value != "" && !idNumberRegex.MatchString(value) {
+			return errors.New("Invalid ID number. Use 4 to 32 letters, digits and '-'.")
+		}
+		p.IdNumber = strings.ToUpper(value)
+	case "date_of_birth":
+		if value == "" {
+			p.DateOfBirth = time.Time{}
+			return nil
+		}
+		dob, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return errors.New("Invalid date of birth, use 2006-01-02: " + value)
+		}
+		if dob.AddDate(MinCustomerAge, 0, 0).After(time.Now()) {
+			return fmt.Errorf("Customers must be at least %d years old.", MinCustomerAge)
+		}
+		if dob.Year() < 1900 {
+			return errors.New("Invalid date of birth: " + value)
+		}
+		p.DateOfBirth = dob
+	case "address":
+		if err := checkText("address", value, 200); err != nil {
+			return err
+		}
+		p.Address = value
+	case "city":
+		if err := checkText("city", value, 100); err != nil {
+			return err
+		}
+		p.City = value
+	case "postal_code":
+		if value != "" && !postalCodeRegex.MatchString(value) {
+			return errors.New("Invalid postal code: " + value)
+		}
+		p.PostalCode = value
+	case "country":
+		value = strings.ToUpper(value)
+		if value != "" && !countryRegex.MatchString(value) {
+			return errors.New("Invalid country, use a two-letter ISO code: " + value)
+		}
+		p.Country = value
+	case "alt_phone":
+		if value != "" && !phoneRegex.MatchString(value) {
+			return errors.New("Invalid phone number: " + value)
+		}
+		p.AltPhone = value
+	case "alt_email":
+		if value != "" {
+			if addr, err := mail.ParseAddress(value); err != nil || addr.Address != value {
+				return errors.New("Invalid email: " + value)
+			}
+		}
+		p.AltEmail = value
+	default:
+		return errors.New("Unknown profile field: " + field)
+	}
+	return nil
+}
+
+// MaskedIdNumber shows the last 4 characters of the ID number only.
+func (p CustomerProfile) MaskedIdNumber() string {
+	n := len(p.IdNumber)
+	if n <= 4 {
+		return strings.Repeat("*", n)
+	}
+	return strings.Repeat("*", n-4) + p.IdNumber[n-4:]
+}
+
+// ProfileOf returns the profile of a user, empty if none was saved yet.
+func ProfileOf(uid UidT) (CustomerProfile, error) {
+	p := CustomerProfile{UId: uid}
+	err := DB_.Select(&p)
+	if err != nil && err.Error() == PgNotFoundErr {
+		return CustomerProfile{UId: uid}, nil
+	}
+	return p, err
+}
@@ -0,0 +1,57 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProfileSet(t *testing.T) {
+	var p CustomerProfile
+	valid := map[string]string{
+		"legal_name": "Zhang San", "id_type": IdPassport, "id_number": "e1234567", "date_of_birth": "1990-05-17",
+		"address": "1 Luoyu Road", "city": "Wuhan", "postal_code": "430074", "country": "cn",
+		"alt_phone": "+86 138 0013 8000", "alt_email": "zs@example.com",
+	}
+	for field, value := range valid {
+		if err := p.Set(field, value); err != nil {
+			t.Errorf("Set(%s, %q): %v", field, value, err)
+		}
+	}
+	if p.IdNumber != "E1234567" || p.Country != "CN" || p.Get("date_of_birth") != "1990-05-17" {
+		t.Errorf("not normalized: %+v", p)
+	}
+
+	tooYoung := time.Now().AddDate(-MinCustomerAge, 0, 1).Format("2006-01-02")
+	invalid := map[string]string{
+		"legal_name": "a\nb", "id_type": "library_card", "id_number": "12", "date_of_birth": tooYoung,
+		"postal_code": "#1", "country": "CHN", "alt_phone": "call me", "alt_email": "Bob <bob@example.com>",
+		"nickname": "bob",
+	}
+	for field, value := range invalid {
+		if err := p.Set(field, value); err == nil {
+			t.Errorf("Set(%s, %q) accepted", field, value)
+		}
+	}
+
+	if err := p.Set("date_of_birth", ""); err != nil || !p.DateOfBirth.IsZero() {
+		t.Errorf("clearing the date of birth: %v", err)
+	}
+}
+
+func TestMaskedIdNumber(t *testing.T) {
+	cases := map[string]string{"": "", "AB1": "***", "E1234567": "****4567"}
+	for in, want := range cases {
+		if got := (CustomerProfile{IdNumber: in}).MaskedIdNumber(); got != want {
+			t.Errorf("MaskedIdNumber(%q): got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMaskedEmail(t *testing.T) {
+	cases := map[string]string{"zs@example.com": "z*@example.com", "a@b.cn": "a@b.cn", "": "", "nobody": "******"}
+	for email, want := range cases {
+		if got := MaskedEmail(email); got != want {
+			t.Errorf("MaskedEmail(%q) = %q, want %q", email, got, want)
+		}
+	}
+}
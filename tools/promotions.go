@@ -0,0 +1,153 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Kinds of Promotion. Discounts are taken off the plan fee as negative invoice lines, for Months
+// billing periods from the redemption; a sign-up bonus is credited to the balance once, when redeemed.
+const (
+	PromoPercent     = "percent"      // Percent off the plan fee
+	PromoFixed       = "fixed"        // Amount off the plan fee
+	PromoFreeMonths  = "free_months"  // the whole plan fee
+	PromoSignupBonus = "signup_bonus" // Amount credited to the balance
+)
+
+var PromoKinds = []string{PromoPercent, PromoFixed, PromoFreeMonths, PromoSignupBonus}
+
+var PromoCodeRegex = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+type PromoidT int64
+
+// Promotion is a discount code. It can be redeemed between ValidFrom and ValidUntil, by at most
+// MaxRedemptions customers, and only by customers on one of Plans and, if NewCustomersOnly, by customers
+// never billed yet. Zero values mean no restriction.
+type Promotion struct {
+	Id               PromoidT `sql:",pk,unique"`
+	Code             string   `sql:",unique,notnull"`
+	Description      string
+	Kind             string   `sql:",notnull"`
+	Percent          int      `sql:",notnull,default:0"`
+	Amount           MoneyT   `sql:",notnull,default:0"`
+	Months           int      `sql:",notnull,default:0"` // billing periods discounted, 0 for every period
+	Plans            []string `sql:",array"`             // plan names, none meaning any
+	NewCustomersOnly bool     `sql:",notnull,default:false"`
+	MaxRedemptions   int      `sql:",notnull,default:0"`
+	Redemptions      int      `sql:",notnull,default:0"`
+	ValidFrom        time.Time
+	ValidUntil       time.Time
+	CreatedBy        UidT
+	CreatedAt        time.Time
+	DisabledAt       time.Time // disabled promotions cannot be redeemed, existing redemptions still apply
+}
+
+func (p Promotion) String() string {
+	return fmt.Sprintf("Promotion<%d %s %s>", p.Id, p.Code, p.Kind)
+}
+
+// Validate checks that the terms of a new promotion make sense.
+func (p Promotion) Validate() error {
+	if !PromoCodeRegex.MatchString(p.Code) {
+		return errors.New("Invalid code, use 3 to 32 upper case letters, digits, - and _.")
+	}
+	switch p.Kind {
+	case PromoPercent:
+		if p.Percent < 1 || p.Percent > 100 {
+			return errors.New("The percentage must be from 1 to 100.")
+		}
+	case PromoFixed, PromoSignupBonus:
+		if p.Amount <= 0 {
+			return errors.New("The amount must be positive.")
+		}
+	case PromoFreeMonths:
+		if p.Months < 1 {
+			return errors.New("Free months need a number of months.")
+		}
+	default:
+		return errors.New("Unknown kind of promotion: " + p.Kind)
+	}
+	if p.Months < 0 || p.MaxRedemptions < 0 {
+		return errors.New("Months and redemption limit must not be negative.")
+	}
+	if !p.ValidFrom.IsZero() && !p.ValidUntil.IsZero() && !p.ValidUntil.After(p.ValidFrom) {
+		return errors.New("The promotion must end after it starts.")
+	}
+	return nil
+}
+
+// Redeemable tells why the promotion cannot be redeemed at the given time, regardless of the customer.
+func (p Promotion) Redeemable(now time.Time) error {
+	switch {
+	case !p.DisabledAt.IsZero():
+		return errors.New("The promotion has been disabled.")
+	case !p.ValidFrom.IsZero() && now.Before(p.ValidFrom):
+		return errors.New("The promotion has not started yet.")
+	case !p.ValidUntil.IsZero() && !now.Before(p.ValidUntil):
+		return errors.New("The promotion has expired.")
+	case p.MaxRedemptions > 0 && p.Redemptions >= p.MaxRedemptions:
+		return errors.New("The promotion has been fully redeemed.")
+	}
+	return nil
+}
+
+// Discount is what the promotion takes off a plan fee, at most the fee. Sign-up bonuses take nothing.
+func (p Promotion) Discount(fee MoneyT) MoneyT {
+	var d MoneyT
+	switch p.Kind {
+	case PromoPercent:
+		d = (fee*MoneyT(p.Percent) + 50) / 100
+	case PromoFixed:
+		d = p.Amount
+	case PromoFreeMonths:
+		d = fee
+	}
+	if d > fee {
+		d = fee
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// Terms describes the discount on invoices, such as "10% off".
+func (p Promotion) Terms() string {
+	switch p.Kind {
+	case PromoPercent:
+		return fmt.Sprintf("%d%% off", p.Percent)
+	case PromoFixed:
+		return p.Amount.String() + " off"
+	case PromoFreeMonths:
+		return "free month"
+	case PromoSignupBonus:
+		return p.Amount.String() + " sign-up bonus"
+	}
+	return p.Kind
+}
+
+// PromotionRedemption is a promotion applied to a customer's account. A customer redeems each promotion
+// once; Periods counts the billing periods discounted so far.
+type PromotionRedemption struct {
+	Id          int64    `sql:",pk,unique"`
+	PromotionId PromoidT `sql:",unique:promotion_redemption"`
+	UId         UidT     `sql:",unique:promotion_redemption"`
+	Periods     int      `sql:",notnull,default:0"`
+	RedeemedBy  UidT
+	RedeemedAt  time.Time
+}
+
+// Active tells whether the redemption still discounts plan fees.
+func (r PromotionRedemption) Active(p Promotion) bool {
+	if p.Kind == PromoSignupBonus {
+		return false
+	}
+	return p.Months == 0 || r.Periods < p.Months
+}
+
+// AppliesToPlan tells whether customers on the named plan are eligible.
+func (p Promotion) AppliesToPlan(plan string) bool {
+	return len(p.Plans) == 0 || ArrayContains(p.Plans, plan)
+}
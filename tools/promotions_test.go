@@ -0,0 +1,72 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPromotionDiscount(t *testing.T) {
+	cases := []struct {
+		p    Promotion
+		fee  MoneyT
+		want MoneyT
+	}{
+		{Promotion{Kind: PromoPercent, Percent: 10}, 1999, 200},
+		{Promotion{Kind: PromoPercent, Percent: 100}, 1999, 1999},
+		{Promotion{Kind: PromoFixed, Amount: 500}, 1999, 500},
+		{Promotion{Kind: PromoFixed, Amount: 5000}, 1999, 1999},
+		{Promotion{Kind: PromoFreeMonths, Months: 2}, 1999, 1999},
+		{Promotion{Kind: PromoSignupBonus, Amount: 500}, 1999, 0},
+	}
+	for _, c := range cases {
+		if got := c.p.Discount(c.fee); got != c.want {
+			t.Errorf("%s of %d: got %d, want %d", c.p.Terms(), c.fee, got, c.want)
+		}
+	}
+}
+
+func TestPromotionValidate(t *testing.T) {
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	good := []Promotion{
+		{Code: "SPRING10", Kind: PromoPercent, Percent: 10, Months: 3},
+		{Code: "FREE-2", Kind: PromoFreeMonths, Months: 2, ValidFrom: day, ValidUntil: day.AddDate(0, 1, 0)},
+		{Code: "WELCOME", Kind: PromoSignupBonus, Amount: 1000, NewCustomersOnly: true},
+	}
+	for _, p := range good {
+		if err := p.Validate(); err != nil {
+			t.Errorf("%s: %v", p, err)
+		}
+	}
+	bad := []Promotion{
+		{Code: "lower", Kind: PromoPercent, Percent: 10},
+		{Code: "PCT", Kind: PromoPercent, Percent: 101},
+		{Code: "FIXED", Kind: PromoFixed},
+		{Code: "FREE", Kind: PromoFreeMonths},
+		{Code: "NONE", Kind: "other"},
+		{Code: "BACK", Kind: PromoFixed, Amount: 1, ValidFrom: day, ValidUntil: day},
+	}
+	for _, p := range bad {
+		if err := p.Validate(); err == nil {
+			t.Errorf("accepted %s", p)
+		}
+	}
+}
+
+func TestPromotionRedeemable(t *testing.T) {
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := Promotion{ValidFrom: day, ValidUntil: day.AddDate(0, 1, 0), MaxRedemptions: 2, Redemptions: 1}
+	if err := p.Redeemable(day); err != nil {
+		t.Error(err)
+	}
+	if p.Redeemable(day.Add(-time.Second)) == nil || p.Redeemable(day.AddDate(0, 1, 0)) == nil {
+		t.Error("outside the window")
+	}
+	p.Redemptions = 2
+	if p.Redeemable(day) == nil {
+		t.Error("over the limit")
+	}
+	p.Redemptions, p.DisabledAt = 0, day
+	if p.Redeemable(day) == nil {
+		t.Error("disabled")
+	}
+}
@@ -0,0 +1,85 @@
+package tools
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket per key, such as a client IP. Each key may spend Burst requests at
+// once, and earns one more every Interval.
+type RateLimiter struct {
+	Burst    int
+	Interval time.Duration
+
+	mutex   sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxRateBuckets bounds the memory of a limiter. Full buckets are forgotten beyond it and, if none is
+// full, the least recently used tenth of them.
+const maxRateBuckets = 10000
+
+func NewRateLimiter(burst int, interval time.Duration) *RateLimiter {
+	return &RateLimiter{Burst: burst, Interval: interval, buckets: make(map[string]*rateBucket)}
+}
+
+// Allow spends a token of the key, and tells whether there was one.
+func (l *RateLimiter) Allow(key string) bool {
+	return l.allowAt(key, time.Now())
+}
+
+func (l *RateLimiter) allowAt(key string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.forgetFullBuckets(now)
+		}
+		if len(l.buckets) >= maxRateBuckets {
+			l.forgetOldestBuckets(maxRateBuckets * 9 / 10)
+		}
+		b = &rateBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += float64(now.Sub(b.last)) / float64(l.Interval)
+	if b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *RateLimiter) forgetFullBuckets(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+float64(now.Sub(b.last))/float64(l.Interval) >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// forgetOldestBuckets keeps the most recently used buckets only. Forgetting a draining bucket gives its
+// key a full burst again, so the oldest, the closest to full, go first.
+func (l *RateLimiter) forgetOldestBuckets(keep int) {
+	keys := make([]string, 0, len(l.buckets))
+	for key := range l.buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return l.buckets[keys[i]].last.After(l.buckets[keys[j]].last) })
+	for _, key := range keys[keep:] {
+		delete(l.buckets, key)
+	}
+}
@@ -0,0 +1,45 @@
+package tools
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(3, time.Minute)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !l.allowAt("1.2.3.4", now) {
+			t.Error("burst should be allowed")
+		}
+	}
+	if l.allowAt("1.2.3.4", now) {
+		t.Error("request beyond the burst allowed")
+	}
+	if !l.allowAt("5.6.7.8", now) {
+		t.Error("keys should not share a bucket")
+	}
+	if !l.allowAt("1.2.3.4", now.Add(time.Minute)) {
+		t.Error("a token should be earned every interval")
+	}
+	if l.allowAt("1.2.3.4", now.Add(time.Minute)) {
+		t.Error("only one token should be earned")
+	}
+}
+
+func TestRateLimiterBounded(t *testing.T) {
+	l := NewRateLimiter(3, time.Hour)
+	now := time.Now()
+	for i := 0; i < maxRateBuckets*2; i++ {
+		// Every bucket is still draining, none can be forgotten as full.
+		l.allowAt(fmt.Sprint(i), now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if len(l.buckets) > maxRateBuckets {
+		t.Errorf("%d buckets", len(l.buckets))
+	}
+	if _, ok := l.buckets[fmt.Sprint(maxRateBuckets*2-1)]; !ok {
+		t.Error("the newest bucket was forgotten")
+	}
+}
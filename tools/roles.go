@@ -0,0 +1,280 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// AllPermissions lists every permission a role can grant.
+var AllPermissions = []string{
+	PermCustomer, PermUserView, PermUserManageCustomers, PermUserManageStaff, PermUserImpersonate,
+	PermProfileView, PermProfileManage, PermDataExport,
+	PermBalanceView, PermBalanceTopup, PermBalanceBatch, PermPromotionManage, PermPromotionRedeem,
+	PermPlanView, PermPlanManage, PermPlanAssign, PermNumberManage, PermNumberAssign, PermSimManage,
+	PermAccountManage, PermCreditManage, PermBillingRun, PermNotificationManage, PermOutboxManage,
+	PermAuditView, PermRoleManage, PermApiKeyManage, PermDatabaseReset,
+}
+
+var RoleNameRegex = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// Role is a named set of permissions. Built-in roles are rewritten at every start and cannot be edited.
+type Role struct {
+	Name        string `sql:",pk"`
+	Description string
+	Builtin     bool `sql:",notnull,default:false"`
+	RequireTotp bool `sql:",notnull,default:false"` // members must log in with a second factor
+}
+
+func (r Role) String() string {
+	return fmt.Sprintf("Role<%s %t>", r.Name, r.Builtin)
+}
+
+// RoleGrant gives one permission to the members of a role. MaxAmount caps the money moved by a single
+// operation under permissions such as PermBalanceTopup, zero meaning no cap.
+type RoleGrant struct {
+	Id         int64  `sql:",pk,unique"`
+	Role       string `sql:",notnull,unique:role_permission"`
+	Permission string `sql:",notnull,unique:role_permission"`
+	MaxAmount  MoneyT `sql:",notnull,default:0"`
+}
+
+func (g RoleGrant) String() string {
+	if g.MaxAmount == 0 {
+		return g.Permission
+	}
+	return g.Permission + ":" + g.MaxAmount.String()
+}
+
+// BuiltinRoles returns the roles every installation has, by name. root holds every staff permission.
+func BuiltinRoles() map[string]Role {
+	return map[string]Role{
+		RoleAdmin:          {Name: RoleAdmin, Description: "Administrator", Builtin: true},
+		ROLE_CASHIER:       {Name: ROLE_CASHIER, Description: "Cashier", Builtin: true},
+		ROLE_CUSTOMER_SERV: {Name: ROLE_CUSTOMER_SERV, Description: "Customer service", Builtin: true},
+		ROLE_CUSTOMER:      {Name: ROLE_CUSTOMER, Description: "Subscriber", Builtin: true},
+	}
+}
+
+func builtinRolePermissions(role string) []string {
+	switch role {
+	case RoleAdmin:
+		var perms []string
+		for _, perm := range AllPermissions {
+			if perm != PermCustomer {
+				perms = append(perms, perm)
+			}
+		}
+		return perms
+	case ROLE_CASHIER:
+		return []string{PermBalanceTopup}
+	case ROLE_CUSTOMER_SERV:
+		return []string{PermUserView, PermUserManageCustomers, PermUserImpersonate, PermProfileView,
+			PermProfileManage, PermDataExport, PermBalanceView, PermPlanView, PermPlanManage,
+			PermPlanAssign, PermNumberAssign, PermSimManage, PermAccountManage, PermNotificationManage,
+			PermPromotionRedeem}
+	case ROLE_CUSTOMER:
+		return []string{PermCustomer}
+	}
+	return nil
+}
+
+// SeedBuiltinRoles writes the built-in roles and their grants, replacing what is stored.
+func SeedBuiltinRoles(db orm.DB) error {
+	for name, role := range BuiltinRoles() {
+		_, err := db.Model(&role).
+			OnConflict("(name) DO UPDATE").
+			Set("description = EXCLUDED.description, builtin = EXCLUDED.builtin").
+			Insert()
+		if err != nil {
+			return err
+		}
+
+		if _, err := db.Model(&RoleGrant{}).Where("role = ?", name).Delete(); err != nil {
+			return err
+		}
+		var grants []RoleGrant
+		for _, perm := range builtinRolePermissions(name) {
+			grants = append(grants, RoleGrant{Role: name, Permission: perm})
+		}
+		if err := db.Insert(&grants); err != nil {
+			return err
+		}
+	}
+	InvalidateAllGrants()
+	return nil
+}
+
+// ParseGrants reads a comma-separated permission list such as `user.view,balance.topup:50.00`,
+// where the optional amount is the MaxAmount of the grant.
+func ParseGrants(role, s string) ([]RoleGrant, error) {
+	var grants []RoleGrant
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		grant := RoleGrant{Role: role, Permission: item}
+		if i := strings.Index(item, ":"); i != -1 {
+			max, err := StringToMoneyT(item[i+1:])
+			if err != nil || max <= 0 {
+				return nil, errors.New("Invalid amount in grant: " + item)
+			}
+			grant.Permission = item[:i]
+			grant.MaxAmount = max
+		}
+		if !ArrayContains(AllPermissions, grant.Permission) {
+			return nil, errors.New("Unknown permission: " + grant.Permission)
+		}
+		if seen[grant.Permission] {
+			return nil, errors.New("Duplicated permission: " + grant.Permission)
+		}
+		seen[grant.Permission] = true
+		grants = append(grants, grant)
+	}
+	return grants, nil
+}
+
+// ParseRoles reads a comma-separated role list and checks that every role exists.
+func ParseRoles(s string) ([]string, error) {
+	var roles []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || ArrayContains(roles, name) {
+			continue
+		}
+		roles = append(roles, name)
+	}
+	if len(roles) == 0 {
+		return roles, nil
+	}
+
+	count, err := DB_.Model(&Role{}).Where("name IN (?)", pg.In(roles)).Count()
+	if err != nil {
+		return nil, err
+	}
+	if count != len(roles) {
+		return nil, errors.New("Unknown role in " + strings.Join(roles, ","))
+	}
+	return roles, nil
+}
+
+// Grants maps the permissions of a user to their MaxAmount.
+type Grants map[string]MoneyT
+
+func (g Grants) Has(perm string) bool {
+	_, ok := g[perm]
+	return ok
+}
+
+// Allows tells whether the grants cover an operation moving the given amount of money, in either direction.
+func (g Grants) Allows(perm string, amount MoneyT) bool {
+	max, ok := g[perm]
+	if !ok {
+		return false
+	}
+	if amount < 0 {
+		amount = -amount
+	}
+	return max == 0 || amount <= max
+}
+
+// Names returns the granted permissions in the order of AllPermissions.
+func (g Grants) Names() []string {
+	var names []string
+	for _, perm := range AllPermissions {
+		if g.Has(perm) {
+			names = append(names, perm)
+		}
+	}
+	return names
+}
+
+// MergeGrants combines the grants of several roles. The most generous cap of a permission wins.
+func MergeGrants(rows []RoleGrant) Grants {
+	grants := make(Grants)
+	for _, row := range rows {
+		max, ok := grants[row.Permission]
+		if !ok || (max != 0 && (row.MaxAmount == 0 || row.MaxAmount > max)) {
+			grants[row.Permission] = row.MaxAmount
+		}
+	}
+	return grants
+}
+
+// RoleGrants resolves the permissions given by a set of roles.
+func RoleGrants(db orm.DB, roles []string) (Grants, error) {
+	if len(roles) == 0 {
+		return make(Grants), nil
+	}
+	var rows []RoleGrant
+	err := db.Model(&rows).Where("role IN (?)", pg.In(roles)).Select()
+	if err != nil && err.Error() != PgNotFoundErr {
+		return nil, err
+	}
+	return MergeGrants(rows), nil
+}
+
+// GrantsCacheTTL bounds how long UserGrants trusts its cache. Changes made through the API invalidate
+// the cache at once, the TTL only covers changes made behind its back.
+var GrantsCacheTTL = 5 * time.Minute
+
+type cachedGrants struct {
+	grants  Grants
+	expires time.Time
+}
+
+var grantsCache = make(map[UidT]cachedGrants)
+var grantsCacheGeneration int64
+var grantsCacheMutex sync.Mutex
+
+// UserGrants resolves the permissions of a user. The result is cached and must not be modified.
+func UserGrants(uid UidT) (Grants, error) {
+	grantsCacheMutex.Lock()
+	cached, ok := grantsCache[uid]
+	generation := grantsCacheGeneration
+	grantsCacheMutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.grants, nil
+	}
+
+	u := UserInfo{Id: uid}
+	if err := DB_.Select(&u); err != nil {
+		return nil, err
+	}
+	grants, err := RoleGrants(DB_, u.Roles)
+	if err != nil {
+		return nil, err
+	}
+
+	grantsCacheMutex.Lock()
+	// Do not store what was read before an invalidation.
+	if generation == grantsCacheGeneration {
+		grantsCache[uid] = cachedGrants{grants, time.Now().Add(GrantsCacheTTL)}
+	}
+	grantsCacheMutex.Unlock()
+	return grants, nil
+}
+
+// InvalidateGrants drops the cached permissions of a user. Call it after committing a change of its roles.
+func InvalidateGrants(uid UidT) {
+	grantsCacheMutex.Lock()
+	defer grantsCacheMutex.Unlock()
+	delete(grantsCache, uid)
+	grantsCacheGeneration++
+}
+
+// InvalidateAllGrants empties the cache. Call it after committing a change of roles or grants.
+func InvalidateAllGrants() {
+	grantsCacheMutex.Lock()
+	defer grantsCacheMutex.Unlock()
+	grantsCache = make(map[UidT]cachedGrants)
+	grantsCacheGeneration++
+}
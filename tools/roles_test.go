@@ -0,0 +1,59 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseGrants(t *testing.T) {
+	grants, err := ParseGrants("teller", "user.view, balance.topup:50.00")
+	if err != nil || len(grants) != 2 || grants[1].Permission != PermBalanceTopup || grants[1].MaxAmount != 5000 {
+		t.Error("parse grants boom")
+	}
+	for _, bad := range []string{"user.fly", "balance.topup:x", "balance.topup:0", "user.view,user.view"} {
+		if _, err := ParseGrants("teller", bad); err == nil {
+			t.Error("bad grants accepted: " + bad)
+		}
+	}
+}
+
+func TestMergeGrants(t *testing.T) {
+	grants := MergeGrants([]RoleGrant{
+		{Role: "a", Permission: PermBalanceTopup, MaxAmount: 1000},
+		{Role: "b", Permission: PermBalanceTopup, MaxAmount: 5000},
+		{Role: "b", Permission: PermUserView},
+	})
+	if !grants.Allows(PermBalanceTopup, -5000) || grants.Allows(PermBalanceTopup, 5001) {
+		t.Error("the most generous cap should win")
+	}
+	if !grants.Has(PermUserView) || grants.Has(PermAuditView) {
+		t.Error("merged permissions boom")
+	}
+
+	unlimited := MergeGrants([]RoleGrant{
+		{Role: "a", Permission: PermBalanceTopup},
+		{Role: "b", Permission: PermBalanceTopup, MaxAmount: 100},
+	})
+	if !unlimited.Allows(PermBalanceTopup, 1000000) {
+		t.Error("an uncapped grant should win")
+	}
+}
+
+func TestGrantsCache(t *testing.T) {
+	grantsCache[42] = cachedGrants{Grants{PermUserView: 0}, time.Now().Add(time.Minute)}
+	grants, err := UserGrants(42)
+	if err != nil || !grants.Has(PermUserView) {
+		t.Error("cached grants should be used without a database")
+	}
+
+	InvalidateGrants(42)
+	if _, ok := grantsCache[42]; ok {
+		t.Error("invalidated grants still cached")
+	}
+
+	grantsCache[42] = cachedGrants{Grants{}, time.Now().Add(time.Minute)}
+	InvalidateAllGrants()
+	if len(grantsCache) != 0 {
+		t.Error("cache not emptied")
+	}
+}
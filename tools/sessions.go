@@ -0,0 +1,217 @@
+package tools
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A session ends SessionIdleTimeout after its last request, and SessionMaxAge after the login at the latest.
+var SessionIdleTimeout = 8 * time.Hour
+var SessionMaxAge = 7 * 24 * time.Hour
+
+// ImpersonationTTL is how long an operator may view the API as a customer before starting over.
+var ImpersonationTTL = 30 * time.Minute
+
+// Session is a login. Its token is the key of the sessions map and is never listed; Id names the
+// session when it is listed or revoked.
+type Session struct {
+	Id        string
+	Uid       UidT
+	Created   time.Time
+	LastSeen  time.Time
+	Ip        string // of the login
+	LastIp    string
+	UserAgent string
+
+	// Impersonator is the operator viewing the API as the user, in a read-only session that ends at Until.
+	// parent is the session of the operator, resumed when the impersonation stops.
+	Impersonator UidT
+	UserName     string
+	Until        time.Time
+	parent       string
+}
+
+// Expires is when the session ends unless it is used again.
+func (s Session) Expires() time.Time {
+	idle := s.LastSeen.Add(SessionIdleTimeout)
+	if max := s.Created.Add(SessionMaxAge); max.Before(idle) {
+		idle = max
+	}
+	if !s.Until.IsZero() && s.Until.Before(idle) {
+		return s.Until
+	}
+	return idle
+}
+
+var sessions = make(map[string]*Session)
+var sessionsMutex sync.Mutex
+
+var errInvalidToken = errors.New("Invalid token")
+
+func randomHex(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// NewSession logs a user in and returns the token of the session.
+func NewSession(uid UidT, ip, userAgent string) (string, error) {
+	token, _, err := addSession(Session{Uid: uid, Ip: ip, LastIp: ip, UserAgent: userAgent})
+	return token, err
+}
+
+// NewImpersonationSession starts a session as a user for the operator logged in with parentToken.
+func NewImpersonationSession(parentToken string, u UserInfo, ip, userAgent string) (string, Session, error) {
+	sessionsMutex.Lock()
+	parent, ok := sessions[parentToken]
+	var operator UidT
+	if ok {
+		operator = parent.Uid
+	}
+	sessionsMutex.Unlock()
+	if !ok {
+		return "", Session{}, errInvalidToken
+	}
+
+	return addSession(Session{Uid: u.Id, Ip: ip, LastIp: ip, UserAgent: userAgent,
+		Impersonator: operator, UserName: u.Name, Until: time.Now().Add(ImpersonationTTL), parent: parentToken})
+}
+
+func addSession(s Session) (string, Session, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", s, err
+	}
+	s.Id, err = randomHex(8)
+	if err != nil {
+		return "", s, err
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	now := time.Now()
+	for t, old := range sessions {
+		if now.After(old.Expires()) {
+			delete(sessions, t)
+		}
+	}
+	s.Created = now
+	s.LastSeen = now
+	sessions[token] = &s
+	return token, s, nil
+}
+
+// EndImpersonation ends an impersonation session. It returns the session and the token of the
+// operator's session, empty if that one is over too.
+func EndImpersonation(token string) (Session, string, error) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	s, ok := sessions[token]
+	if !ok || s.Impersonator == 0 {
+		return Session{}, "", errors.New("This is not an impersonation session.")
+	}
+	delete(sessions, token)
+	if parent, ok := sessions[s.parent]; ok && !time.Now().After(parent.Expires()) {
+		return *s, s.parent, nil
+	}
+	return *s, "", nil
+}
+
+// VerifyToken returns the session of a token and records its use from the given address.
+func VerifyToken(token, ip string) (Session, error) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	s, ok := sessions[token]
+	if !ok {
+		return Session{}, errInvalidToken
+	}
+	now := time.Now()
+	if now.After(s.Expires()) {
+		delete(sessions, token)
+		return Session{}, errors.New("Session expired")
+	}
+	s.LastSeen = now
+	s.LastIp = ip
+	return *s, nil
+}
+
+func DoLogout(token string) error {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if _, ok := sessions[token]; !ok {
+		return errInvalidToken
+	}
+	delete(sessions, token)
+	return nil
+}
+
+// UserSessions lists the live sessions of a user, oldest first.
+func UserSessions(uid UidT) []Session {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	now := time.Now()
+	var list []Session
+	for _, s := range sessions {
+		if s.Uid == uid && !now.After(s.Expires()) {
+			list = append(list, *s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// csrfKey signs the CSRF tokens. Sessions do not survive a restart, so neither needs the key.
+var csrfKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// CsrfToken is the CSRF token of a session. Pages send it back in a header, which other sites cannot do.
+func CsrfToken(sessionToken string) string {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(sessionToken))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func CheckCsrfToken(sessionToken, csrf string) bool {
+	return hmac.Equal([]byte(CsrfToken(sessionToken)), []byte(csrf))
+}
+
+// RevokeSession ends one session of a user.
+func RevokeSession(uid UidT, id string) error {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	for token, s := range sessions {
+		if s.Uid == uid && s.Id == id {
+			delete(sessions, token)
+			return nil
+		}
+	}
+	return errors.New("Session not found: " + id)
+}
+
+// RevokeUserSessions ends every session of a user, including the impersonations the user started as
+// an operator, and returns how many there were.
+func RevokeUserSessions(uid UidT) int {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	count := 0
+	for token, s := range sessions {
+		if s.Uid == uid || s.Impersonator == uid {
+			delete(sessions, token)
+			count++
+		}
+	}
+	return count
+}
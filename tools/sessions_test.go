@@ -0,0 +1,93 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	a, err := NewSession(1001, "10.0.0.1", "curl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewSession(1001, "10.0.0.2", "firefox")
+	c, _ := NewSession(1002, "10.0.0.3", "curl")
+
+	s, err := VerifyToken(a, "10.0.0.9")
+	if err != nil || s.Uid != 1001 || s.Ip != "10.0.0.1" || s.LastIp != "10.0.0.9" {
+		t.Errorf("got %+v, %v", s, err)
+	}
+	if list := UserSessions(1001); len(list) != 2 {
+		t.Errorf("got %d sessions", len(list))
+	}
+
+	if err := RevokeSession(1002, s.Id); err == nil {
+		t.Error("a session was revoked for another user")
+	}
+	if err := RevokeSession(1001, s.Id); err != nil {
+		t.Error(err)
+	}
+	if _, err := VerifyToken(a, ""); err == nil {
+		t.Error("revoked token accepted")
+	}
+
+	if n := RevokeUserSessions(1001); n != 1 {
+		t.Errorf("revoked %d sessions", n)
+	}
+	if _, err := VerifyToken(b, ""); err == nil {
+		t.Error("token accepted after logging out everywhere")
+	}
+	if _, err := VerifyToken(c, ""); err != nil {
+		t.Error("the sessions of other users should survive")
+	}
+	RevokeUserSessions(1002)
+}
+
+func TestSessionExpires(t *testing.T) {
+	now := time.Now()
+	s := Session{Created: now.Add(-SessionMaxAge), LastSeen: now}
+	if !s.Expires().Equal(now) {
+		t.Error("a session should end SessionMaxAge after the login")
+	}
+	s = Session{Created: now, LastSeen: now}
+	if !s.Expires().Equal(now.Add(SessionIdleTimeout)) {
+		t.Error("a session should end SessionIdleTimeout after its last use")
+	}
+}
+
+func TestImpersonationSession(t *testing.T) {
+	parent, _ := NewSession(1001, "10.0.0.1", "firefox")
+	token, s, err := NewImpersonationSession(parent, UserInfo{Id: 1002, Name: "alice"}, "10.0.0.1", "firefox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Uid != 1002 || s.Impersonator != 1001 || s.UserName != "alice" {
+		t.Errorf("got %+v", s)
+	}
+	if !s.Expires().Equal(s.Until) || s.Until.After(time.Now().Add(ImpersonationTTL)) {
+		t.Error("an impersonation session should end after ImpersonationTTL")
+	}
+
+	if _, _, err := EndImpersonation(parent); err == nil {
+		t.Error("a login session was ended as an impersonation")
+	}
+	ended, resumed, err := EndImpersonation(token)
+	if err != nil || resumed != parent || ended.Id != s.Id {
+		t.Errorf("got %s, %v", resumed, err)
+	}
+	if _, err := VerifyToken(token, ""); err == nil {
+		t.Error("ended impersonation token accepted")
+	}
+
+	if _, _, err := NewImpersonationSession("no such token", UserInfo{Id: 1002}, "", ""); err == nil {
+		t.Error("impersonation started without a session")
+	}
+
+	token, _, _ = NewImpersonationSession(parent, UserInfo{Id: 1002, Name: "alice"}, "10.0.0.1", "firefox")
+	if n := RevokeUserSessions(1001); n != 2 {
+		t.Errorf("revoked %d sessions", n)
+	}
+	if _, err := VerifyToken(token, ""); err == nil {
+		t.Error("impersonation survived the revocation of its operator")
+	}
+}
@@ -0,0 +1,37 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const (
+	SimInStock   = "in_stock"
+	SimActivated = "activated"
+	SimLost      = "lost"
+	SimBlocked   = "blocked"
+)
+
+var IccidRegex = regexp.MustCompile(`^[0-9]{19,20}$`)
+var ImsiRegex = regexp.MustCompile(`^[0-9]{15}$`)
+var SimPinRegex = regexp.MustCompile(`^[0-9]{4,8}$`)
+var SimPukRegex = regexp.MustCompile(`^[0-9]{8}$`)
+
+// SimCard is one physical SIM. While activated it is paired with the subscriber line Number.
+type SimCard struct {
+	Iccid       string `sql:",pk"`
+	Imsi        string `sql:",unique"`
+	Pin         string
+	Puk         string
+	State       string `sql:",notnull"`
+	UId         UidT
+	Number      string
+	ActivatedAt time.Time
+	BlockReason string
+	BlockedAt   time.Time
+}
+
+func (s SimCard) String() string {
+	return fmt.Sprintf("SimCard<%s %s %d %s>", s.Iccid, s.State, s.UId, s.Number)
+}
@@ -0,0 +1,129 @@
+package tools
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+
+	"github.com/go-pg/pg/orm"
+)
+
+// Brand is the carrier name shown in every email.
+var Brand = "TMobile"
+
+const DefaultLanguage = "en"
+
+var SupportedLanguages = []string{"en", "zh"}
+
+// An email template is one file, <dir>/<lang>/<name>.tmpl, defining the three blocks "subject",
+// "text" and "html". The html block is escaped with html/template, the other two are plain text.
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+var emailTemplates map[string]emailTemplate
+var emailTemplatesMutex sync.RWMutex
+
+// LoadEmailTemplates parses every template under dir. Every language must provide the same templates.
+func LoadEmailTemplates(dir string) error {
+	templates := make(map[string]emailTemplate)
+	var names []string
+	for _, lang := range SupportedLanguages {
+		files, err := filepath.Glob(filepath.Join(dir, lang, "*.tmpl"))
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return errors.New("No email template found for language " + lang + " in " + dir)
+		}
+
+		var langNames []string
+		for _, file := range files {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+
+			t := emailTemplate{}
+			t.text, err = texttemplate.New(name).Option("missingkey=error").Parse(string(content))
+			if err != nil {
+				return err
+			}
+			t.html, err = htmltemplate.New(name).Option("missingkey=error").Parse(string(content))
+			if err != nil {
+				return err
+			}
+			for _, block := range []string{"subject", "text", "html"} {
+				if t.text.Lookup(block) == nil {
+					return errors.New("Email template " + file + " does not define " + block)
+				}
+			}
+			templates[lang+"/"+name] = t
+			langNames = append(langNames, name)
+		}
+
+		if names == nil {
+			names = langNames
+		} else if strings.Join(names, ",") != strings.Join(langNames, ",") {
+			return errors.New("Email templates of language " + lang + " differ from " + SupportedLanguages[0])
+		}
+	}
+
+	emailTemplatesMutex.Lock()
+	emailTemplates = templates
+	emailTemplatesMutex.Unlock()
+	return nil
+}
+
+// RenderEmail builds an email from a template in the given language, falling back to the default
+// language. The brand is available to templates as .Brand.
+func RenderEmail(name, lang, to string, data map[string]interface{}) (Email, error) {
+	emailTemplatesMutex.RLock()
+	t, ok := emailTemplates[lang+"/"+name]
+	if !ok {
+		t, ok = emailTemplates[DefaultLanguage+"/"+name]
+	}
+	emailTemplatesMutex.RUnlock()
+	if !ok {
+		return Email{}, errors.New("Email template not found: " + name)
+	}
+
+	values := map[string]interface{}{"Brand": Brand}
+	for k, v := range data {
+		values[k] = v
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := t.text.ExecuteTemplate(&subject, "subject", values); err != nil {
+		return Email{}, err
+	}
+	if err := t.text.ExecuteTemplate(&text, "text", values); err != nil {
+		return Email{}, err
+	}
+	if err := t.html.ExecuteTemplate(&html, "html", values); err != nil {
+		return Email{}, err
+	}
+
+	return Email{
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Body:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    strings.TrimSpace(html.String()) + "\n",
+	}, nil
+}
+
+// EnqueueTemplatedEmail renders a template in the user's language and queues it, see EnqueueEmail.
+func EnqueueTemplatedEmail(db orm.DB, u UserInfo, name string, data map[string]interface{}) error {
+	e, err := RenderEmail(name, u.Language, u.Email, data)
+	if err != nil {
+		return err
+	}
+	return EnqueueEmail(db, e)
+}
@@ -0,0 +1,40 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEmailTemplates(t *testing.T) {
+	if err := LoadEmailTemplates("../templates/email"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	data := map[string]interface{}{
+		"Name": "alice", "Link": "http://x/changePassword.html?old=a&name=alice",
+		"Period": "2026-09", "DaysOverdue": 7, "Amount": "10.00", "AmountDue": "10.00", "DueDate": "2026-10-15",
+		"Balance": "1.00", "Threshold": "10.00", "PlanName": "<basic>", "PlanPrice": "10.00",
+	}
+	for key := range emailTemplates {
+		parts := strings.SplitN(key, "/", 2)
+		e, err := RenderEmail(parts[1], parts[0], "alice@recolic.net", data)
+		if err != nil {
+			t.Error(key + ": " + err.Error())
+			continue
+		}
+		if e.Subject == "" || !strings.Contains(e.Body, Brand) || !strings.Contains(e.HTML, Brand) {
+			t.Error(key + ": incomplete email")
+		}
+		if strings.Contains(e.HTML, "<basic>") {
+			t.Error(key + ": html part is not escaped")
+		}
+	}
+
+	e, err := RenderEmail("password_reset", "fr", "alice@recolic.net", data)
+	if err != nil || !strings.HasPrefix(e.Subject, Brand+" password") {
+		t.Error("unsupported language should fall back to " + DefaultLanguage)
+	}
+	if _, err := RenderEmail("password_reset", "en", "alice@recolic.net", map[string]interface{}{}); err == nil {
+		t.Error("missing template data should fail")
+	}
+}
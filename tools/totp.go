@@ -0,0 +1,185 @@
+package tools
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// TOTP as of RFC 6238 with the parameters every authenticator app supports: HMAC-SHA1, 6 digits, 30 seconds.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// Codes of the neighbouring periods are accepted too, to tolerate clock drift.
+	totpSkew = 1
+)
+
+const recoveryCodeCount = 10
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// RecoveryCode replaces a TOTP code once, for a user who lost the authenticator.
+type RecoveryCode struct {
+	Id       int64 `sql:",pk,unique"`
+	UId      UidT  `sql:",notnull"`
+	CodeHash string
+	UsedAt   time.Time
+}
+
+func (c RecoveryCode) String() string {
+	return fmt.Sprintf("RecoveryCode<%d %d>", c.Id, c.UId)
+}
+
+// GenerateTotpSecret returns a new base32 encoded secret.
+func GenerateTotpSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TotpUrl is the otpauth:// link authenticator apps import, usually from a QR code.
+func TotpUrl(username, secret string) string {
+	label := url.PathEscape(Brand + ":" + username)
+	v := url.Values{"secret": {secret}, "issuer": {Brand}}
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// hotp is the HOTP value of RFC 4226 for a counter.
+func hotp(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// matchTotp returns the time step whose code is the given one, or -1.
+func matchTotp(secret, code string, now time.Time) int64 {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return -1
+	}
+	step := now.Unix() / totpPeriod
+	for i := step - totpSkew; i <= step+totpSkew; i++ {
+		if hmac.Equal([]byte(hotp(key, uint64(i))), []byte(code)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkTotp accepts a current TOTP code of the user once: a code, or an older one, cannot be replayed.
+func checkTotp(db orm.DB, u UserInfo, code string) bool {
+	step := matchTotp(u.TotpSecret, code, time.Now())
+	if step < 0 {
+		return false
+	}
+	res, err := db.Model(&UserInfo{Id: u.Id}).
+		Set("totp_last_step = ?", step).
+		Where("id = ? AND totp_last_step < ?", u.Id, step).
+		Update()
+	return err == nil && res.RowsAffected() == 1
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// useRecoveryCode spends one of the user's recovery codes.
+func useRecoveryCode(db orm.DB, uid UidT, code string) bool {
+	res, err := db.Model(&RecoveryCode{}).
+		Set("used_at = ?", time.Now()).
+		Where("u_id = ? AND code_hash = ? AND used_at IS NULL", uid, hashRecoveryCode(code)).
+		Update()
+	return err == nil && res.RowsAffected() == 1
+}
+
+// CheckSecondFactor accepts a TOTP code or an unused recovery code.
+func CheckSecondFactor(db orm.DB, u UserInfo, code string) bool {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		return checkTotp(db, u, code)
+	}
+	return useRecoveryCode(db, u.Id, code)
+}
+
+// ResetRecoveryCodes replaces the recovery codes of a user and returns the new ones. Only hashes are stored.
+func ResetRecoveryCodes(db orm.DB, uid UidT) ([]string, error) {
+	if _, err := db.Model(&RecoveryCode{}).Where("u_id = ?", uid).Delete(); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+		rows[i] = RecoveryCode{UId: uid, CodeHash: hashRecoveryCode(code)}
+	}
+	return codes, db.Insert(&rows)
+}
+
+// EnableTotp turns on the second factor of a user once the first code of its pending secret is verified,
+// and returns fresh recovery codes.
+func EnableTotp(u UserInfo, code string) ([]string, error) {
+	if u.TotpSecret == "" {
+		return nil, errors.New("No TOTP enrollment in progress.")
+	}
+	if u.TotpEnabled {
+		return nil, errors.New("TOTP is already enabled.")
+	}
+
+	var codes []string
+	err := DB_.RunInTransaction(func(tx *pg.Tx) error {
+		if !checkTotp(tx, u, code) {
+			return errors.New("Invalid TOTP code.")
+		}
+		_, err := tx.Model(&UserInfo{Id: u.Id}).Set("totp_enabled = TRUE").WherePK().Update()
+		if err != nil {
+			return err
+		}
+		codes, err = ResetRecoveryCodes(tx, u.Id)
+		return err
+	})
+	return codes, err
+}
+
+// TotpRequired tells whether one of the user's roles requires the second factor.
+func TotpRequired(u UserInfo) (bool, error) {
+	if len(u.Roles) == 0 {
+		return false, nil
+	}
+	count, err := DB_.Model(&Role{}).Where("name IN (?) AND require_totp", pg.In(u.Roles)).Count()
+	return count > 0, err
+}
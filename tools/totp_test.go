@@ -0,0 +1,52 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors of RFC 6238, truncated to 6 digits.
+func TestHotpRfc6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+	cases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range cases {
+		if got := hotp(key, uint64(unix/totpPeriod)); got != want {
+			t.Errorf("hotp at %d: got %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestMatchTotp(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(59, 0)
+
+	if step := matchTotp(secret, "287082", now); step != 1 {
+		t.Errorf("current code: got step %d", step)
+	}
+	if step := matchTotp(secret, "287082", now.Add(totpPeriod*time.Second)); step != 1 {
+		t.Errorf("code of the previous period should be accepted, got step %d", step)
+	}
+	if step := matchTotp(secret, "287082", now.Add(3*totpPeriod*time.Second)); step != -1 {
+		t.Errorf("stale code accepted at step %d", step)
+	}
+	if step := matchTotp(secret, "28708", now); step != -1 {
+		t.Error("short code accepted")
+	}
+	if step := matchTotp("not base32!", "287082", now); step != -1 {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestRecoveryCodeHash(t *testing.T) {
+	if hashRecoveryCode("ABCD-efgh") != hashRecoveryCode(" abcd efgh") {
+		t.Error("recovery codes should ignore case, dashes and spaces")
+	}
+	if hashRecoveryCode("abcd-efgh") == hashRecoveryCode("abcd-efgi") {
+		t.Error("different codes share a hash")
+	}
+}